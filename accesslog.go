@@ -0,0 +1,78 @@
+package main
+
+// Combined Log Format access logs, for log tooling that expects Apache style
+// lines.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Records what was sent so it can be logged once the handler is done.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Lets http.ResponseController reach the real writer.
+func (w *loggingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func combinedLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &loggingWriter{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(lw, r)
+
+		if logExcluded(r.URL.Path) {
+			return
+		}
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		bytes := "-"
+		if lw.bytes > 0 {
+			bytes = strconv.FormatInt(lw.bytes, 10)
+		}
+		user, _, _ := r.BasicAuth()
+		fmt.Printf("%s - %s [%s] %q %d %s %q %q\n",
+			clientIP(r),
+			dashIfEmpty(user),
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+truncateLogged(r.RequestURI)+" "+r.Proto,
+			status,
+			bytes,
+			dashIfEmpty(r.Referer()),
+			dashIfEmpty(r.UserAgent()),
+		)
+	})
+}
+
+// CLF writes a dash for missing values.
+func dashIfEmpty(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestCombinedLogFormat(t *testing.T) {
+	configure(t)
+	h := combinedLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+
+	out := captureOutput(t, func() {
+		request(h.ServeHTTP, "GET", "/api/v1/dependencies?gems=rack", "", "User-Agent", "bundler/2.4", "Referer", "https://ci.example.com/")
+		request(h.ServeHTTP, "GET", "/health", "")
+	})
+	line := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /api/v1/dependencies\?gems=rack HTTP/1\.1" 418 15 "https://ci\.example\.com/" "bundler/2\.4"\n$`)
+	if !line.MatchString(out) {
+		t.Errorf("logged %q", out)
+	}
+}
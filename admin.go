@@ -0,0 +1,229 @@
+package main
+
+// Admin and debug endpoints, only served when -admin-token is set.
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Flags whose values must never be shown by /debug/config.
+var secretFlags = map[string]bool{
+	"admin-token": true,
+	"auth-pass":   true,
+	"sign-key":    true,
+}
+
+// Requests must carry the admin token as a bearer token. Without an admin
+// token configured the endpoints don't exist at all.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminTokenFlag == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminTokenFlag)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+type debugRepo struct {
+	Priority     int               `json:"priority"`
+	URL          string            `json:"url"`
+	DepsPath     string            `json:"deps_path"`
+	DownloadBase string            `json:"download_base,omitempty"`
+	Pins         []string          `json:"pins,omitempty"`
+	Routes       []string          `json:"routes,omitempty"`
+	MaxRequests  int               `json:"max_requests,omitempty"`
+	Aliases      map[string]string `json:"aliases,omitempty"`
+	Accept       string            `json:"accept,omitempty"`
+	ParamNames   []string          `json:"param_names,omitempty"`
+	Timeout      string            `json:"timeout,omitempty"`
+}
+
+func debugRepos(rs repos) []debugRepo {
+	var out []debugRepo
+	for i, repo := range rs {
+		var download string
+		if repo.downloadBase != nil {
+			download = redactURL(repo.downloadBase)
+		}
+		// Param values can be tenant tokens, so only their names are shown.
+		var params []string
+		for name := range repo.params {
+			params = append(params, name)
+		}
+		sort.Strings(params)
+		var timeout string
+		if repo.timeout > 0 {
+			timeout = repo.timeout.String()
+		}
+		out = append(out, debugRepo{
+			Priority:     i,
+			URL:          repo.public(),
+			DepsPath:     repo.depsPath,
+			DownloadBase: download,
+			Pins:         repo.pins,
+			Routes:       repo.routes,
+			MaxRequests:  cap(repo.sem),
+			Aliases:      repo.aliases,
+			Accept:       repo.accept,
+			ParamNames:   params,
+			Timeout:      timeout,
+		})
+	}
+	return out
+}
+
+// Shows the configuration that actually took effect.
+func handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	config := struct {
+		Repos         []debugRepo       `json:"repos"`
+		FallbackRepos []debugRepo       `json:"fallback_repos,omitempty"`
+		Flags         map[string]string `json:"flags"`
+	}{
+		Repos:         debugRepos(reposFlag),
+		FallbackRepos: debugRepos(fallbackReposFlag),
+		Flags:         make(map[string]string),
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch {
+		case f.Name == "repo" || f.Name == "fallback-repo":
+		case secretFlags[f.Name]:
+			if f.Value.String() != "" {
+				config.Flags[f.Name] = "REDACTED"
+			}
+		default:
+			config.Flags[f.Name] = f.Value.String()
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// Warms the cache and gemDir for a set of gems, given as a gems= parameter or
+// in the body as a list of names or a Gemfile.lock, without sending the
+// result anywhere.
+func handlePrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gems, err := splitGemNames(r.URL.Query().Get("gems"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := parseGemList(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	var unique []string
+	for _, gem := range append(gems, body...) {
+		if !seen[gem] {
+			seen[gem] = true
+			unique = append(unique, gem)
+		}
+	}
+	gems = unique
+	if len(gems) == 0 {
+		http.Error(w, "No gems given", http.StatusBadRequest)
+		return
+	}
+
+	deps, err := depQuery(gems, requestOptions(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"gems": len(gems), "versions": len(deps)})
+}
+
+// Reads gem names either from a Gemfile.lock or a comma or whitespace
+// separated list, refusing anything that can't be a gem name.
+func parseGemList(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if isLockfile(b) {
+		locked, err := parseLockfile(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		for _, gem := range locked {
+			names = append(names, gem.name)
+		}
+	} else {
+		names = strings.FieldsFunc(string(b), func(c rune) bool { return c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r' })
+	}
+	return splitGemNames(strings.Join(names, ","))
+}
+
+func isLockfile(b []byte) bool {
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "specs:" {
+			return true
+		}
+	}
+	return false
+}
+
+// Clears the dependency cache and/or gemDir, so a newly pushed gem is visible
+// without waiting out TTLs. what= may be cache, gemdir or all (the default),
+// and gems= limits the purge to the given gems.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var gems []string
+	if v := r.URL.Query().Get("gems"); v != "" {
+		gems = strings.Split(v, ",")
+	}
+
+	what := r.URL.Query().Get("what")
+	if what == "" {
+		what = "all"
+	}
+	if what != "all" && what != "cache" && what != "gemdir" {
+		http.Error(w, "what must be cache, gemdir or all", http.StatusBadRequest)
+		return
+	}
+
+	purged := make(map[string]int)
+	if what != "gemdir" {
+		purged["cache"] = depCache.purge(gems) + purgeRepoCache(gems)
+	}
+	if what != "cache" {
+		purged["gemdir"] = purgeGemDir(gems)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(purged)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuth(t *testing.T) {
+	configure(t, "-auth-user", "ci", "-auth-pass", "hunter2")
+	h := requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+
+	for _, c := range []struct {
+		user, pass string
+		path       string
+		want       int
+	}{
+		{"", "", "/api/v1/dependencies", http.StatusUnauthorized},
+		{"ci", "wrong", "/api/v1/dependencies", http.StatusUnauthorized},
+		{"other", "hunter2", "/gems/rack-1.0.0.gem", http.StatusUnauthorized},
+		{"ci", "hunter2", "/api/v1/dependencies", http.StatusOK},
+		{"", "", "/health", http.StatusOK},
+		{"", "", "/ready", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.path, nil)
+		if c.user != "" {
+			r.SetBasicAuth(c.user, c.pass)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s as %s:%s got %d, want %d", c.path, c.user, c.pass, w.Code, c.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="amalgemate"` {
+			t.Errorf("%s got WWW-Authenticate %q", c.path, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestNoAuthByDefault(t *testing.T) {
+	configure(t)
+	w := httptest.NewRecorder()
+	requireAuth(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/dependencies", nil))
+	if w.Code == http.StatusUnauthorized {
+		t.Error("auth required without -auth-user")
+	}
+}
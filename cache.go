@@ -0,0 +1,458 @@
+package main
+
+// Caches merged dependency query results, in memory and optionally on disk so
+// that a restart doesn't start cold.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var depCache resultCache
+
+// Where merged query results are kept. newCache provides the built in memory
+// and disk cache, but anything that can hold entries for a TTL will do.
+type resultCache interface {
+	// Finds an entry, which is stale if it has expired but is still within
+	// -stale-while-revalidate, or at all with -offline.
+	get(key string) (deps []gemInfo, stale bool, ok bool)
+	set(key string, gems []string, deps []gemInfo, ttl time.Duration)
+	// Drops every entry covering any of the gems, or everything when no gems
+	// are given, returning how many were dropped.
+	purge(gems []string) int
+}
+
+// Overrides -cache-ttl for gem names matching a pattern.
+type ttlOverride struct {
+	pattern string
+	ttl     time.Duration
+}
+
+type ttlOverrides []ttlOverride
+
+func (s *ttlOverrides) String() string {
+	var parts []string
+	for _, o := range *s {
+		parts = append(parts, o.pattern+"="+o.ttl.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s *ttlOverrides) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected pattern=duration, got %q", v)
+	}
+	if _, err := path.Match(kv[0], ""); err != nil {
+		return err
+	}
+	ttl, err := time.ParseDuration(kv[1])
+	if err != nil {
+		return err
+	}
+
+	*s = append(*s, ttlOverride{pattern: kv[0], ttl: ttl})
+	return nil
+}
+
+// An entry covers several gems, so it lives only as long as the shortest
+// lived of them. The first matching override applies to a gem.
+func cacheTTLFor(gems []string) time.Duration {
+	ttl := time.Duration(-1)
+	for _, gem := range gems {
+		gemTTL := cacheTTLFlag
+		for _, o := range cacheTTLOverridesFlag {
+			if ok, _ := path.Match(o.pattern, gem); ok {
+				gemTTL = o.ttl
+				break
+			}
+		}
+		if ttl < 0 || gemTTL < ttl {
+			ttl = gemTTL
+		}
+	}
+	if ttl < 0 {
+		return cacheTTLFlag
+	}
+	return ttl
+}
+
+type cacheEntry struct {
+	Expires time.Time   `json:"expires"`
+	Gems    []string    `json:"gems"`
+	Deps    []cachedGem `json:"deps"`
+}
+
+// gemInfo doesn't serialize its repo, so it's carried alongside.
+type cachedGem struct {
+	gemInfo
+	Repo    string   `json:"repo"`
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+type cache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	dir      string
+	maxBytes int64
+}
+
+func newCache(dir string, maxBytes int64) *cache {
+	return &cache{
+		entries:  make(map[string]*cacheEntry),
+		dir:      dir,
+		maxBytes: maxBytes,
+	}
+}
+
+// Queries for the same set of gems with the same options share an entry,
+// whatever order the gems were asked for in. The repos, with the options that
+// change what the merge makes of them, are part of the key along with
+// -version-strategy, so entries persisted before the repos were reordered or
+// reconfigured aren't served as the old config merged them.
+func cacheKey(gems []string, opts queryOptions) string {
+	sorted := append([]string(nil), gems...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%t\n%t\n%s", strings.Join(sorted, ","), opts.merge, opts.excludePrerelease, opts.requireAllRepos, versionStrategyFlag)
+	for _, r := range reposFlag {
+		fmt.Fprintf(h, "\n%s", repoKey(r))
+	}
+	for _, r := range fallbackReposFlag {
+		fmt.Fprintf(h, "\nfallback %s", repoKey(r))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func repoKey(r *repository) string {
+	aliases := make([]string, 0, len(r.aliases))
+	for name, published := range r.aliases {
+		aliases = append(aliases, name+":"+published)
+	}
+	sort.Strings(aliases)
+	return fmt.Sprintf("%s pin=%s route=%s alias=%s", r.public(), strings.Join(r.pins, ","), strings.Join(r.routes, ","), strings.Join(aliases, ","))
+}
+
+func (c *cache) get(key string) ([]gemInfo, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok && c.dir != "" {
+		entry, ok = c.load(key)
+		if ok {
+			c.entries[key] = entry
+		}
+	}
+	if !ok {
+		return nil, false, false
+	}
+	now := time.Now()
+	// Offline, an expired entry is still the best answer there is, and it's
+	// kept for as long as the repos are out of reach.
+	if now.After(entry.Expires.Add(staleWhileRevalidateFlag)) && !offlineFlag {
+		delete(c.entries, key)
+		if c.dir != "" {
+			os.Remove(c.path(key))
+		}
+		return nil, false, false
+	}
+	stale := now.After(entry.Expires)
+
+	deps := make([]gemInfo, len(entry.Deps))
+	for i, cached := range entry.Deps {
+		deps[i] = cached.gemInfo
+		deps[i].repo = findRepo(cached.Repo)
+		if deps[i].repo == nil {
+			// The repo is no longer configured.
+			delete(c.entries, key)
+			return nil, false, false
+		}
+		deps[i].mirrors = nil
+		for _, m := range cached.Mirrors {
+			if mirror := findRepo(m); mirror != nil {
+				deps[i].mirrors = append(deps[i].mirrors, mirror)
+			}
+		}
+	}
+	return deps, stale, true
+}
+
+func (c *cache) set(key string, gems []string, deps []gemInfo, ttl time.Duration) {
+	entry := &cacheEntry{
+		Expires: time.Now().Add(ttl),
+		Gems:    gems,
+		Deps:    make([]cachedGem, len(deps)),
+	}
+	// Repos are recorded by their public URL, so credentials never reach
+	// -cache-dir.
+	for i, dep := range deps {
+		entry.Deps[i] = cachedGem{gemInfo: dep, Repo: dep.repo.public()}
+		for _, mirror := range dep.mirrors {
+			entry.Deps[i].Mirrors = append(entry.Deps[i].Mirrors, mirror.public())
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Entries for gem sets that are never asked for again would otherwise
+	// stay in memory forever. Those on disk are bounded by -cache-max-bytes.
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.Expires.Add(staleWhileRevalidateFlag)) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+	if c.dir != "" {
+		if err := c.persist(key, entry); err != nil {
+			fmt.Println("Failed to persist cache entry:", err)
+		}
+	}
+}
+
+// Drops every entry covering any of the gems, or everything when no gems are
+// given. Returns how many entries were dropped.
+func (c *cache) purge(gems []string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	matches := func(entry *cacheEntry) bool {
+		if len(gems) == 0 {
+			return true
+		}
+		for _, a := range entry.Gems {
+			for _, b := range gems {
+				if a == b {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	purged := make(map[string]bool)
+	for key, entry := range c.entries {
+		if matches(entry) {
+			delete(c.entries, key)
+			purged[key] = true
+		}
+	}
+
+	if c.dir != "" {
+		files, _ := ioutil.ReadDir(c.dir)
+		for _, f := range files {
+			if filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			key := strings.TrimSuffix(f.Name(), ".json")
+			if !purged[key] {
+				entry, ok := c.load(key)
+				if !ok || !matches(entry) {
+					continue
+				}
+			}
+			os.Remove(c.path(key))
+			purged[key] = true
+		}
+	}
+
+	return len(purged)
+}
+
+// Estimates the memory held by entries, from their encoded size.
+func (c *cache) memoryBytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := 0
+	for _, entry := range c.entries {
+		for i := range entry.Deps {
+			total += entry.Deps[i].size()
+		}
+	}
+	return total
+}
+
+func (c *cache) path(key string) string {
+	return filepath.Join(c.dir, key+".json")
+}
+
+func (c *cache) load(key string) (*cacheEntry, bool) {
+	b, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		fmt.Printf("Discarding unreadable cache entry %s: %s\n", key, err)
+		os.Remove(c.path(key))
+		return nil, false
+	}
+
+	// Eviction is least recently used, by modification time.
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	return &entry, true
+}
+
+func (c *cache) persist(key string, entry *cacheEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Written to a temp file first so a crash never leaves a torn entry.
+	tmp, err := ioutil.TempFile(c.dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return c.evict()
+}
+
+// Removes the least recently used entries from disk until the total size is
+// within maxBytes.
+func (c *cache) evict() error {
+	if c.maxBytes <= 0 {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	var entries []os.FileInfo
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		total += f.Size()
+		entries = append(entries, f)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, f := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, f.Name())); err != nil {
+			return err
+		}
+		delete(c.entries, strings.TrimSuffix(f.Name(), ".json"))
+		total -= f.Size()
+	}
+	return nil
+}
+
+// Caches each repo's own answers beneath the merged results, for
+// -repo-cache-ttl. Merged entries are keyed by the query options and the
+// whole repo set, so queries that merge differently, or that route to an
+// overlapping set of repos, can still share what a repo said.
+var repoCache = struct {
+	sync.Mutex
+	entries map[string]repoCacheEntry
+}{entries: make(map[string]repoCacheEntry)}
+
+type repoCacheEntry struct {
+	expires time.Time
+	gems    []string
+	deps    []gemInfo
+}
+
+func repoCacheKey(repo *repository, gems []string) string {
+	sorted := append([]string(nil), gems...)
+	sort.Strings(sorted)
+	return repo.String() + "\n" + strings.Join(sorted, ",")
+}
+
+func getRepoCache(repo *repository, gems []string) ([]gemInfo, bool) {
+	key := repoCacheKey(repo, gems)
+	repoCache.Lock()
+	defer repoCache.Unlock()
+
+	entry, ok := repoCache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(repoCache.entries, key)
+		return nil, false
+	}
+	// The merge appends mirrors to what it's given.
+	return append([]gemInfo(nil), entry.deps...), true
+}
+
+func setRepoCache(repo *repository, gems []string, deps []gemInfo) {
+	now := time.Now()
+	repoCache.Lock()
+	defer repoCache.Unlock()
+
+	// Entries for gem sets that are never asked for again would otherwise
+	// stay forever.
+	for key, entry := range repoCache.entries {
+		if now.After(entry.expires) {
+			delete(repoCache.entries, key)
+		}
+	}
+	repoCache.entries[repoCacheKey(repo, gems)] = repoCacheEntry{
+		expires: now.Add(repoCacheTTLFlag),
+		gems:    gems,
+		deps:    append([]gemInfo(nil), deps...),
+	}
+}
+
+// Drops every repo answer covering any of the gems, or all of them when no
+// gems are given. Returns how many were dropped.
+func purgeRepoCache(gems []string) int {
+	repoCache.Lock()
+	defer repoCache.Unlock()
+
+	purged := 0
+	for key, entry := range repoCache.entries {
+		matched := len(gems) == 0
+		for _, a := range entry.gems {
+			for _, b := range gems {
+				if a == b {
+					matched = true
+				}
+			}
+		}
+		if matched {
+			delete(repoCache.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachePersistsAcrossRestarts(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	u, _ := url.Parse(repo.URL)
+	u.User = url.UserPassword("user", "secret")
+	dir := t.TempDir()
+	configure(t, "-cache-ttl", "1h", "-cache-dir", dir, "-repo", u.String())
+
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("persisted %v", files)
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("credentials persisted: %s", b)
+	}
+
+	// A restart starts with an empty cache in memory and the repo down.
+	repo.fail(500)
+	configure(t, "-cache-ttl", "1h", "-cache-dir", dir, "-repo", u.String())
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].repo != reposFlag[0] {
+		t.Errorf("got %v from %v", idents(deps), deps)
+	}
+	if n := repo.requestCount(); n != 1 {
+		t.Errorf("repo asked %d times", n)
+	}
+}
+
+func TestCacheDropsEntriesForRemovedRepos(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"))
+	dir := t.TempDir()
+	configure(t, "-cache-ttl", "1h", "-cache-dir", dir, "-repo", first.URL)
+	key := cacheKey([]string{"rack"}, defaultOptions())
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	configure(t, "-cache-ttl", "1h", "-cache-dir", dir, "-repo", second.URL)
+	if _, _, ok := depCache.get(key); ok {
+		t.Error("entry served after its repo was removed")
+	}
+}
+
+func TestCacheSweepsExpiredEntries(t *testing.T) {
+	configure(t)
+	c := newCache("", 0)
+	c.set("old", []string{"old"}, nil, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.set("new", []string{"new"}, nil, time.Hour)
+
+	if _, ok := c.entries["old"]; ok {
+		t.Error("expired entry still held in memory")
+	}
+	if _, ok := c.entries["new"]; !ok {
+		t.Error("new entry missing")
+	}
+}
+
+func TestCacheTTLOverride(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"), gem("mycorp-auth", "1.0.0"))
+	configure(t, "-cache-ttl", "1h", "-cache-ttl-override", "mycorp-*=20ms", "-repo", repo.URL)
+
+	if got := cacheTTLFor([]string{"rack", "mycorp-auth"}); got != 20*time.Millisecond {
+		t.Errorf("mixed entry lives %s", got)
+	}
+	for _, gems := range [][]string{{"rack"}, {"mycorp-auth"}} {
+		if _, err := depQuery(gems, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+	for _, gems := range [][]string{{"rack"}, {"mycorp-auth"}} {
+		if _, err := depQuery(gems, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asked := repo.asked()
+	if len(asked) != 3 || !equalStrings(asked[2], []string{"mycorp-auth"}) {
+		t.Errorf("asked %v", asked)
+	}
+}
+
+// Keeps entries forever, recording what it's asked.
+type fakeCache struct {
+	entries map[string][]gemInfo
+	gets    int
+}
+
+func (c *fakeCache) get(key string) ([]gemInfo, bool, bool) {
+	c.gets++
+	deps, ok := c.entries[key]
+	return deps, false, ok
+}
+
+func (c *fakeCache) set(key string, gems []string, deps []gemInfo, ttl time.Duration) {
+	c.entries[key] = deps
+}
+
+func (c *fakeCache) purge(gems []string) int {
+	n := len(c.entries)
+	c.entries = make(map[string][]gemInfo)
+	return n
+}
+
+func TestCacheContract(t *testing.T) {
+	for name, dir := range map[string]string{"memory": "", "disk": t.TempDir()} {
+		configure(t, "-stale-while-revalidate", "1h", "-repo", "https://gems.example.com/")
+		c := newCache(dir, 0)
+		rack := gem("rack", "1.0.0")
+		rack.repo = reposFlag[0]
+
+		if _, _, ok := c.get("rack"); ok {
+			t.Errorf("%s: empty cache has an entry", name)
+		}
+		c.set("rack", []string{"rack"}, []gemInfo{rack}, time.Hour)
+		c.set("rack,thor", []string{"rack", "thor"}, []gemInfo{rack}, -time.Minute)
+		c.set("rails", []string{"rails"}, nil, time.Hour)
+
+		if deps, stale, ok := c.get("rack"); !ok || stale || len(deps) != 1 || deps[0].repo != reposFlag[0] {
+			t.Errorf("%s: got %v, stale %t, ok %t", name, idents(deps), stale, ok)
+		}
+		if _, stale, ok := c.get("rack,thor"); !ok || !stale {
+			t.Errorf("%s: expired entry stale %t, ok %t", name, stale, ok)
+		}
+		if n := c.purge([]string{"thor"}); n != 1 {
+			t.Errorf("%s: purged %d entries for thor", name, n)
+		}
+		if _, _, ok := c.get("rack,thor"); ok {
+			t.Errorf("%s: purged entry still served", name)
+		}
+		if n := c.purge(nil); n != 2 {
+			t.Errorf("%s: purged %d of the rest", name, n)
+		}
+	}
+}
+
+func TestHandlerUsesCache(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-cache-ttl", "1h", "-repo", repo.URL)
+	fake := &fakeCache{entries: make(map[string][]gemInfo)}
+	depCache = fake
+
+	cached := gem("rack", "9.9.9")
+	cached.repo = reposFlag[0]
+	fake.entries[cacheKey([]string{"rack"}, defaultOptions())] = []gemInfo{cached}
+
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-9.9.9"}) {
+		t.Errorf("got %v", got)
+	}
+	if n := repo.requestCount(); n != 0 || fake.gets != 1 {
+		t.Errorf("repo asked %d times, cache %d", n, fake.gets)
+	}
+
+	// A miss is fetched and handed to the cache.
+	request(handleDependencies, "GET", dependencies("rack", "rails"), "")
+	if _, ok := fake.entries[cacheKey([]string{"rack", "rails"}, defaultOptions())]; !ok {
+		t.Error("result not cached")
+	}
+}
+
+func TestCacheKeyCoversMergeConfig(t *testing.T) {
+	base := []string{"-repo", "https://a.example.com/", "-repo", "https://b.example.com/"}
+	configure(t, base...)
+	key := cacheKey([]string{"rack", "rails"}, defaultOptions())
+	if other := cacheKey([]string{"rails", "rack"}, defaultOptions()); other != key {
+		t.Error("gem order changes the key")
+	}
+
+	for _, args := range [][]string{
+		{"-repo", "https://b.example.com/", "-repo", "https://a.example.com/"},
+		{"-repo", "https://a.example.com/,pin=rack", "-repo", "https://b.example.com/"},
+		{"-repo", "https://a.example.com/", "-repo", "https://b.example.com/,route=mycorp-*"},
+		{"-repo", "https://a.example.com/,alias=rack:rack-fork", "-repo", "https://b.example.com/"},
+		append([]string{"-fallback-repo", "https://c.example.com/"}, base...),
+		append([]string{"-version-strategy", "freshest"}, base...),
+	} {
+		configure(t, args...)
+		if cacheKey([]string{"rack", "rails"}, defaultOptions()) == key {
+			t.Errorf("%v shares a key with %v", args, base)
+		}
+	}
+}
+
+func TestOfflineServesExpiredEntries(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	dir := t.TempDir()
+	configure(t, "-cache-ttl", "10ms", "-cache-dir", dir, "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	configure(t, "-offline", "-cache-ttl", "10ms", "-cache-dir", dir, "-repo", repo.URL)
+	for i := 0; i < 2; i++ {
+		deps, err := depQuery([]string{"rack"}, defaultOptions())
+		if err != nil || !equalStrings(idents(deps), []string{"rack-1.0.0"}) {
+			t.Errorf("got %v, %v", idents(deps), err)
+		}
+	}
+	if n := repo.requestCount(); n != 1 {
+		t.Errorf("repo asked %d times", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(files) != 1 {
+		t.Errorf("expired entry deleted offline, left %v", files)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-cache-ttl", "10ms", "-stale-while-revalidate", "1h", "-repo", repo.URL)
+	key := cacheKey([]string{"rack"}, defaultOptions())
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	repo.add(gem("rack", "1.1.0"))
+	repo.setLatency(100 * time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		deps, err := depQuery([]string{"rack"}, defaultOptions())
+		if err != nil || !equalStrings(idents(deps), []string{"rack-1.0.0"}) {
+			t.Errorf("stale hit got %v, %v", idents(deps), err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("stale hits took %s", d)
+	}
+
+	// The refreshed entry goes stale again after 10ms, too quickly to poll
+	// for, so wait for the refresh itself.
+	backgroundQueries.Wait()
+	if deps, _, ok := depCache.get(key); !ok || len(deps) != 2 {
+		t.Errorf("refreshed to %v", idents(deps))
+	}
+	if n := len(repo.asked()); n != 2 {
+		t.Errorf("repo asked %d times", n)
+	}
+}
+
+func TestRepoCache(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"))
+	configure(t, "-repo-cache-ttl", "1h", "-repo", first.URL, "-repo", second.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A query merging differently still uses what each repo said.
+	opts := defaultOptions()
+	opts.merge = mergePriority
+	deps, err := depQuery([]string{"rack"}, opts)
+	if err != nil || !equalStrings(served(deps), []string{"rack-1.0.0@" + first.URL}) {
+		t.Errorf("priority merge got %v, %v", served(deps), err)
+	}
+	if a, b := len(first.asked()), len(second.asked()); a != 1 || b != 1 {
+		t.Errorf("repos asked %d and %d times", a, b)
+	}
+
+	// The second repo's answer expires, and only it is asked again.
+	second.add(gem("rack", "2.1.0"))
+	repoCache.Lock()
+	key := repoCacheKey(reposFlag[1], []string{"rack"})
+	entry := repoCache.entries[key]
+	entry.expires = time.Now().Add(-time.Second)
+	repoCache.entries[key] = entry
+	repoCache.Unlock()
+
+	deps, err = depQuery([]string{"rack"}, defaultOptions())
+	if err != nil || !equalStrings(idents(deps), []string{"rack-1.0.0", "rack-2.0.0", "rack-2.1.0"}) {
+		t.Errorf("got %v, %v", idents(deps), err)
+	}
+	if a, b := len(first.asked()), len(second.asked()); a != 1 || b != 2 {
+		t.Errorf("repos asked %d and %d times", a, b)
+	}
+
+	if n := purgeRepoCache([]string{"rack"}); n != 2 {
+		t.Errorf("purged %d entries", n)
+	}
+}
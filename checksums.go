@@ -0,0 +1,94 @@
+package main
+
+// Verifies downloads against a list of trusted checksums, so a compromised or
+// tampered repo can't hand out a different gem under a known name.
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trusted SHA-256 checksums, keyed by file name.
+var trustedChecksums map[string]string
+
+// Reads checksums in the format sha256sum writes, a hex digest and a file
+// name per line.
+func loadTrustedChecksums(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+			return nil, fmt.Errorf("%s:%d: expected a SHA-256 digest and a file name", file, line)
+		}
+		sums[path.Base(strings.TrimPrefix(fields[1], "*"))] = strings.ToLower(fields[0])
+	}
+	return sums, scanner.Err()
+}
+
+func trustedChecksum(p string) string {
+	return trustedChecksums[path.Base(p)]
+}
+
+// Downloads the file from the repo in full and only sends it on if it matches
+// its trusted checksum. It's spooled to disk, since gems can be large.
+func proxyVerified(w http.ResponseWriter, r *http.Request, repo *repository, p, sum string) error {
+	res, err := fetchDownload(r, repo, p)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	tmp, err := ioutil.TempFile("", "amalgemate-download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), res.Body)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("checksum %s doesn't match the trusted %s", got, sum)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(downloadTimeoutFlag))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, tmp); err != nil {
+		fmt.Printf("Failed to send verified %s from repo %s: %s\n", p, repo.public(), err)
+		return nil
+	}
+	fmt.Printf("Proxied verified %s from repo %s, %d bytes\n", p, repo.public(), n)
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func writeChecksums(t *testing.T, lines string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "SHA256SUMS")
+	if err := ioutil.WriteFile(file, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestTrustedChecksums(t *testing.T) {
+	sum := sha256.Sum256([]byte("from second"))
+	file := writeChecksums(t, "# pinned\n"+hex.EncodeToString(sum[:])+" *gems/rack-1.0.0.gem\n")
+
+	// The first repo's copy has been tampered with.
+	first, second := mirroredRack(t, "-trusted-checksums", file)
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusOK || w.Body.String() != "from second" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+
+	second.fail(http.StatusNotFound)
+	w = request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusBadGateway || w.Body.String() == "from first" {
+		t.Errorf("mismatching copy got %d %q", w.Code, w.Body)
+	}
+	if first.requestCount() < 2 {
+		t.Error("repo without a trusted copy never asked")
+	}
+}
+
+func TestLoadTrustedChecksumsRefusesMalformedLines(t *testing.T) {
+	for _, lines := range []string{
+		"abc123  rack-1.0.0.gem\n",
+		"rack-1.0.0.gem\n",
+	} {
+		if _, err := loadTrustedChecksums(writeChecksums(t, lines)); err == nil {
+			t.Errorf("%q loaded", lines)
+		}
+	}
+}
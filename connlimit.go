@@ -0,0 +1,67 @@
+package main
+
+// Caps the connections a single client IP can hold open at once, so one client
+// can't take up every connection the server has. The limit applies to the
+// peer address, so behind a load balancer it limits the balancer.
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+type limitListener struct {
+	net.Listener
+	max   int
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newLimitListener(l net.Listener, max int) *limitListener {
+	return &limitListener{Listener: l, max: max, conns: make(map[string]int)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+		if err != nil {
+			return c, nil
+		}
+
+		l.mu.Lock()
+		if l.conns[ip] >= l.max {
+			l.mu.Unlock()
+			fmt.Printf("Refusing connection from %s, already at -max-conns-per-ip\n", ip)
+			c.Close()
+			continue
+		}
+		l.conns[ip]++
+		l.mu.Unlock()
+
+		return &limitedConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *limitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -3,23 +3,169 @@ package main
 // Handle the /api/v1/dependencies API.
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/samcday/rmarsh"
 )
 
+const (
+	// Every version from every repo is served, a collision on ident is won by
+	// the higher priority repo.
+	mergeUnion = "union"
+	// A gem name is served entirely from the highest priority repo that has
+	// any version of it.
+	mergePriority = "priority"
+)
+
+const (
+	// A collision on ident is won by the higher priority repo.
+	versionPriority = "priority"
+	// A collision on ident is won by the repo whose response was most
+	// recently modified, per its Last-Modified header, so a lagging mirror
+	// doesn't win just by being listed first.
+	versionFreshest = "freshest"
+	// A collision on ident is won by the repo that has failed the fewest of
+	// its recent queries, so downloads go to the more reliable mirror.
+	versionHealthiest = "healthiest"
+)
+
+func validVersionStrategy(s string) bool {
+	return s == versionPriority || s == versionFreshest || s == versionHealthiest
+}
+
+// Whether dep should take over from kept, which has the same ident, under
+// -version-strategy. Ties stay with kept, the higher priority repo.
+func preferVersion(dep, kept *gemInfo) bool {
+	switch versionStrategyFlag {
+	case versionFreshest:
+		return dep.modified.After(kept.modified)
+	case versionHealthiest:
+		return dep.repo.errorRate() < kept.repo.errorRate()
+	}
+	return false
+}
+
+// Controls how a single dependency query is resolved and merged.
+type queryOptions struct {
+	merge             string
+	excludePrerelease bool
+	requireAllRepos   bool
+	// Collects a summary of the query when the client asked for one.
+	stats *queryStats
+	// How long to wait for the query before giving up, or zero to wait for
+	// as long as it takes.
+	timeout time.Duration
+	// Skips the cache and -primary-then-verify, to replace a stale entry or
+	// verify a primary result.
+	refresh bool
+	// Set on the one query whose result coalesced requests share.
+	coalesced bool
+	// Collects Server-Timing entries with -server-timing.
+	timing *serverTiming
+	// Marked when the result leaves out repos that hadn't answered yet.
+	partial *partialResult
+	// Done once the query's timeout has passed, abandoning its upstream
+	// requests. Nil when there's no timeout.
+	ctx context.Context
+}
+
+func (o queryOptions) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// Whether the query's timeout has passed, so what the repos said may be cut
+// short.
+func (o queryOptions) expired() bool {
+	return o.ctx != nil && o.ctx.Err() != nil
+}
+
+// A result answered without every repo is only good for the client that asked,
+// so it's marked as such. Nil when nobody needs to know.
+type partialResult struct{ atomic.Bool }
+
+func (p *partialResult) mark() {
+	if p != nil {
+		p.Store(true)
+	}
+}
+
+func (p *partialResult) marked() bool {
+	return p != nil && p.Load()
+}
+
+func validMerge(s string) bool {
+	return s == mergeUnion || s == mergePriority
+}
+
+// The options given by flags.
+func defaultOptions() queryOptions {
+	return queryOptions{
+		merge:             mergeFlag,
+		excludePrerelease: excludePrereleaseFlag,
+		requireAllRepos:   requireAllReposFlag,
+		timeout:           requestTimeoutFlag,
+	}
+}
+
+// Builds the options for a request, starting from the global defaults and
+// applying any X-Amalgemate-* header overrides that have been allowed.
+// Invalid or disallowed overrides are ignored.
+func requestOptions(r *http.Request) queryOptions {
+	opts := defaultOptions()
+
+	if v := r.Header.Get("X-Amalgemate-Merge"); v != "" && allowOverridesFlag.has("merge") && validMerge(v) {
+		opts.merge = v
+	}
+	if v := r.Header.Get("X-Amalgemate-Exclude-Prerelease"); v != "" && allowOverridesFlag.has("prerelease") {
+		if b, err := strconv.ParseBool(v); err == nil {
+			opts.excludePrerelease = b
+		}
+	}
+	if v := r.Header.Get("X-Amalgemate-Require-All-Repos"); v != "" && allowOverridesFlag.has("require-all-repos") {
+		if b, err := strconv.ParseBool(v); err == nil {
+			opts.requireAllRepos = b
+		}
+	}
+
+	return opts
+}
+
 type gemInfo struct {
-	repo         *url.URL
-	Name         string     `rmarsh:"name"`
-	Version      string     `rmarsh:"number"`
-	Platform     string     `rmarsh:"platform"`
-	Dependencies [][]string `rmarsh:"dependencies"`
+	repo         *repository
+	mirrors      []*repository // Lower priority repos that also have this exact gem.
+	modified     time.Time     // The upstream response's Last-Modified, if it sent one.
+	Name         string        `rmarsh:"name" json:"name"`
+	Version      string        `rmarsh:"number" json:"number"`
+	Platform     string        `rmarsh:"platform" json:"platform"`
+	Dependencies [][]string    `rmarsh:"dependencies" json:"dependencies"`
+	// Only some upstreams send these. They're passed on as given, for only
+	// the gems they were sent for, by marshalPayload.
+	RubyVersion     string `rmarsh:"ruby_version" json:"ruby_version,omitempty"`
+	RubygemsVersion string `rmarsh:"rubygems_version" json:"rubygems_version,omitempty"`
 }
 
+// The gem's file name without extension, as RubyGems builds it. A name can
+// itself have hyphens and digits in it, so gemDir is looked up with the
+// requested file name whole, and keeps the name, version and platform
+// alongside for anything that needs them.
 func (g *gemInfo) ident() string {
 	suffix := ""
 	if g.Platform != "ruby" {
@@ -28,75 +174,1305 @@ func (g *gemInfo) ident() string {
 	return fmt.Sprintf("%s-%s%s", g.Name, g.Version, suffix)
 }
 
+// A rough upper bound on the encoded size of the entry, without encoding it.
+func (g *gemInfo) size() int {
+	// Allow for the hash, its keys and the type and length bytes.
+	n := 64 + len(g.Name) + len(g.Version) + len(g.Platform)
+	n += 48 + len(g.RubyVersion) + len(g.RubygemsVersion)
+	for _, dep := range g.Dependencies {
+		n += 8
+		for _, s := range dep {
+			n += 8 + len(s)
+		}
+	}
+	return n
+}
+
+// RubyGems treats any version containing a letter as a prerelease.
+func (g *gemInfo) prerelease() bool {
+	return strings.IndexFunc(g.Version, unicode.IsLetter) >= 0
+}
+
+// The JSON variant of the dependencies API isn't bound to the marshal schema
+// Bundler expects, so it also says where each gem will be downloaded from.
+type jsonGemInfo struct {
+	gemInfo
+	// Shadows gemInfo's, so it can be left out with dependencies=false.
+	Dependencies *[][]string `json:"dependencies,omitempty"`
+	Source       string      `json:"source"`
+	GemURI       string      `json:"gem_uri"`
+}
+
+func jsonDependencies(deps []gemInfo, slim bool) []jsonGemInfo {
+	out := make([]jsonGemInfo, len(deps))
+	for i, dep := range deps {
+		out[i] = jsonGemInfo{
+			gemInfo: dep,
+			Source:  dep.repo.public(),
+			GemURI:  redactURL(dep.repo.download("gems/" + dep.ident() + ".gem")),
+		}
+		if !slim {
+			out[i].Dependencies = &deps[i].Dependencies
+		}
+	}
+	return out
+}
+
+// A gem as Bundler expects it in a marshal response.
+type marshalGemInfo struct {
+	Name         string     `rmarsh:"name"`
+	Version      string     `rmarsh:"number"`
+	Platform     string     `rmarsh:"platform"`
+	Dependencies [][]string `rmarsh:"dependencies"`
+}
+
+// A gem whose upstream also said which Ruby and RubyGems it needs.
+type marshalGemInfoVersions struct {
+	Name            string     `rmarsh:"name"`
+	Version         string     `rmarsh:"number"`
+	Platform        string     `rmarsh:"platform"`
+	Dependencies    [][]string `rmarsh:"dependencies"`
+	RubyVersion     string     `rmarsh:"ruby_version"`
+	RubygemsVersion string     `rmarsh:"rubygems_version"`
+}
+
+// Sends ruby_version and rubygems_version only for the gems whose upstream
+// sent them, rather than as empty strings for every gem.
+func marshalPayload(deps []gemInfo) interface{} {
+	versions := false
+	for i := range deps {
+		if deps[i].RubyVersion != "" || deps[i].RubygemsVersion != "" {
+			versions = true
+			break
+		}
+	}
+	if !versions {
+		out := make([]marshalGemInfo, len(deps))
+		for i, dep := range deps {
+			out[i] = marshalGemInfo{Name: dep.Name, Version: dep.Version, Platform: dep.Platform, Dependencies: dep.Dependencies}
+		}
+		return out
+	}
+
+	out := make([]interface{}, len(deps))
+	for i, dep := range deps {
+		if dep.RubyVersion == "" && dep.RubygemsVersion == "" {
+			out[i] = marshalGemInfo{Name: dep.Name, Version: dep.Version, Platform: dep.Platform, Dependencies: dep.Dependencies}
+			continue
+		}
+		out[i] = marshalGemInfoVersions{
+			Name:            dep.Name,
+			Version:         dep.Version,
+			Platform:        dep.Platform,
+			Dependencies:    dep.Dependencies,
+			RubyVersion:     dep.RubyVersion,
+			RubygemsVersion: dep.RubygemsVersion,
+		}
+	}
+	return out
+}
+
+// Just enough to identify a gem, for marshal responses with dependencies left
+// out.
+type slimGemInfo struct {
+	Name     string `rmarsh:"name"`
+	Version  string `rmarsh:"number"`
+	Platform string `rmarsh:"platform"`
+}
+
+// Clients that only need to know which versions exist can ask for responses
+// without dependencies, which are most of a response's size.
+func withoutDependencies(r *http.Request) bool {
+	b, err := strconv.ParseBool(r.FormValue("dependencies"))
+	return err == nil && !b
+}
+
+func handleDependencies(w http.ResponseWriter, r *http.Request) {
+	result, ok := queryRequest(w, r)
+	if !ok {
+		return
+	}
+	// Set rather than left to sniffing, which can take marshal data for
+	// text.
+	w.Header().Set("Content-Type", marshalContentTypeFlag)
+
+	// Bundler needs the dependencies, so it's opt in.
+	payload := marshalPayload(result)
+	if allowSlimMarshalFlag && withoutDependencies(r) {
+		slim := make([]slimGemInfo, len(result))
+		for i, dep := range result {
+			slim[i] = slimGemInfo{Name: dep.Name, Version: dep.Version, Platform: dep.Platform}
+		}
+		payload = slim
+	}
+
+	// Encoding into memory first means a failed encode can still be a clean
+	// 500, rather than a corrupt stream after a 200. Only very large responses
+	// are streamed, accepting that risk. Responses over -max-merged-bytes are
+	// streamed with -max-merged-policy=stream even when they'd be cached,
+	// since their buffer is what the budget is protecting against.
+	stream := cacheTTLFlag <= 0 && streamThresholdFlag > 0 && encodedSize(result) > streamThresholdFlag
+	if maxMergedBytesFlag > 0 && maxMergedPolicyFlag == "stream" && encodedSize(result) > maxMergedBytesFlag {
+		stream = true
+	}
+	writeMarshal(w, r, payload, stream)
+}
+
+// Sends a marshal response, encoded into memory first unless it's to be
+// streamed.
+func writeMarshal(w http.ResponseWriter, r *http.Request, payload interface{}, stream bool) {
+	if stream {
+		if err := rmarsh.NewEncoder(w).Encode(payload); err != nil {
+			fmt.Println("Failed to write dependencies response:", err)
+		}
+		return
+	}
+
+	start := time.Now()
+	var buf bytes.Buffer
+	if err := rmarsh.NewEncoder(&buf).Encode(payload); err != nil {
+		fmt.Println("Failed to encode dependencies response:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addTiming(w, "encode", "Marshal encoding", start)
+
+	if cacheTTLFlag > 0 {
+		writeCacheable(w, r, buf.Bytes())
+		return
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		fmt.Println("Failed to write dependencies response:", err)
+	}
+}
+
+func handleDependenciesJSON(w http.ResponseWriter, r *http.Request) {
+	result, ok := queryRequest(w, r)
+	if !ok {
+		return
+	}
+
+	out := jsonDependencies(result, withoutDependencies(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	overBudget := maxMergedBytesFlag > 0 && maxMergedPolicyFlag == "stream" && encodedSize(result) > maxMergedBytesFlag
+	if cacheTTLFlag <= 0 || overBudget {
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			fmt.Println("Failed to write dependencies response:", err)
+		}
+		return
+	}
+
+	start := time.Now()
+	body, err := json.Marshal(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	addTiming(w, "encode", "JSON encoding", start)
+	writeCacheable(w, r, body)
+}
+
+// Writes a response body that intermediaries and clients may cache for as long
+// as amalgemate would. The merge is deterministic, so the ETag is derived from the body
+// itself and identical repeat requests can be answered with a 304.
+func writeCacheable(w http.ResponseWriter, r *http.Request, body []byte) {
+	// A partial result, as marked by queryRequest.
+	if w.Header().Get("Cache-Control") == "no-store" {
+		w.Write(body)
+		return
+	}
+
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	ttl := cacheTTLFor(strings.Split(r.FormValue("gems"), ","))
+	cacheControl := fmt.Sprintf("public, max-age=%d", int(ttl.Seconds()))
+	if staleWhileRevalidateFlag > 0 {
+		cacheControl += fmt.Sprintf(", stale-while-revalidate=%d", int(staleWhileRevalidateFlag.Seconds()))
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		metrics.add(metricNotModifiedBytes, float64(len(body)))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Write(body)
+}
+
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the dependency query described by the request. Returns false if there
+// is nothing further to write.
+func queryRequest(w http.ResponseWriter, r *http.Request) ([]gemInfo, bool) {
+	// Long query strings get cut short by some proxies, so past
+	// -max-query-length the client is told to POST the gems instead, as a
+	// form body.
+	if r.Method == "GET" && maxQueryLengthFlag > 0 && len(r.URL.RawQuery) > maxQueryLengthFlag {
+		http.Error(w, fmt.Sprintf("Query string over %d bytes, POST the gems as a form instead", maxQueryLengthFlag), http.StatusRequestURITooLong)
+		return nil, false
+	}
+	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
+	}
+
+	query := r.FormValue("gems")
+	if query == "" {
+		return nil, false
+	}
+	gems, err := splitGemNames(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if len(gems) == 0 {
+		return nil, false
+	}
+	traceGems(r, len(gems))
+
+	opts := requestOptions(r)
+	if wantStats(r) {
+		opts.stats = newQueryStats(len(gems))
+	}
+	opts.timing = newServerTiming()
+	opts.partial = new(partialResult)
+
+	// Unlike the other overrides a bad timeout is refused, since a client
+	// with a latency budget needs to know it isn't being kept.
+	if v := r.Header.Get("X-Amalgemate-Timeout"); v != "" && maxRequestTimeoutFlag > 0 {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 || timeout > maxRequestTimeoutFlag {
+			http.Error(w, fmt.Sprintf("X-Amalgemate-Timeout must be a duration up to %s", maxRequestTimeoutFlag), http.StatusBadRequest)
+			return nil, false
+		}
+		opts.timeout = timeout
+	}
+
+	start := time.Now()
+	result, ok, err := boundedQuery(gems, opts)
+	opts.timing.add("query", "Cache lookup, upstream fetches and merge", time.Since(start))
+	if !ok {
+		fmt.Printf("Dependency query exceeded its timeout of %s\n", opts.timeout)
+		http.Error(w, "Timed out waiting for upstream repositories", http.StatusGatewayTimeout)
+		return nil, false
+	}
+	if err == errMaintenance {
+		writeMaintenance(w)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// One gem can easily be missing everywhere, but every gem of a bundle
+	// being missing usually means the repos are out of sync or serving the
+	// wrong thing, and an empty answer would quietly break the install.
+	if len(gems) > 1 && len(result) == 0 {
+		metrics.add(metricEmptyMerges, 1)
+		fmt.Printf("Warning: none of the %d gems asked for were found in any repo\n", len(gems))
+		if strictEmptyMergeFlag {
+			http.Error(w, fmt.Sprintf("None of the %d gems were found in any repository", len(gems)), http.StatusBadGateway)
+			return nil, false
+		}
+	}
+
+	// Bundler expects missing gems to simply be left out, but other clients
+	// may prefer to hear about them.
+	if missing := missingNames(gems, result); len(missing) > 0 {
+		suggestions := suggestNames(missing)
+		if len(suggestions) > 0 {
+			w.Header().Set("X-Amalgemate-Suggestions", formatSuggestions(suggestions))
+		}
+		if strictMissingFlag {
+			msg := "Gems not found in any repository: " + strings.Join(missing, ", ")
+			if len(suggestions) > 0 {
+				msg += " (closest known names: " + formatSuggestions(suggestions) + ")"
+			}
+			http.Error(w, msg, http.StatusNotFound)
+			return nil, false
+		}
+	}
+
+	// No point encoding a response nobody will read.
+	if err := r.Context().Err(); err != nil {
+		fmt.Println("Client went away before dependencies could be sent:", err)
+		return nil, false
+	}
+
+	if requestOrderFlag {
+		result = inRequestOrder(result, gems)
+	}
+
+	if platforms := r.FormValue("platforms"); platforms != "" {
+		result = filterPlatforms(result, strings.Split(platforms, ","))
+	}
+
+	if maxMergedBytesFlag > 0 && maxMergedPolicyFlag != "stream" {
+		if n := fitSize(result, maxMergedBytesFlag); n < len(result) {
+			if maxMergedPolicyFlag != "truncate" {
+				http.Error(w, fmt.Sprintf("Response would exceed %d bytes, request fewer gems", maxMergedBytesFlag), http.StatusBadRequest)
+				return nil, false
+			}
+			fmt.Printf("Truncating response from %d to %d gems\n", len(result), n)
+			w.Header().Set("X-Amalgemate-Truncated", strconv.Itoa(len(result)-n))
+			result = result[:n]
+		}
+	}
+
+	// Neither clients nor intermediaries may hold on to a partial result,
+	// the complete one is cached here once the slow repos have answered.
+	if opts.partial.marked() {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if opts.stats != nil {
+		opts.stats.write(w)
+	}
+	opts.timing.write(w)
+	return result, true
+}
+
+// Query work still running after its caller has an answer, such as queries
+// boundedQuery gave up waiting for, which keep going until their repos answer
+// or time out.
+var backgroundQueries sync.WaitGroup
+
+// Runs depQuery, giving up once the query's timeout has passed. The timeout
+// reaches the upstream requests too, so an abandoned query doesn't hold on to
+// upstream slots, and its incomplete result isn't cached.
+func boundedQuery(gems []string, opts queryOptions) ([]gemInfo, bool, error) {
+	if opts.timeout <= 0 {
+		deps, err := retryQuery(gems, opts)
+		return deps, true, err
+	}
+
+	// Not cancelled when the query returns, since repos that missed
+	// -repo-soft-deadline may still be finishing in the background. They
+	// have until the timeout, which releases the context by itself.
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	_ = cancel
+	opts.ctx = ctx
+
+	type result struct {
+		deps []gemInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	backgroundQueries.Add(1)
+	go func() {
+		defer backgroundQueries.Done()
+		deps, err := retryQuery(gems, opts)
+		done <- result{deps, err}
+	}()
+
+	timer := time.NewTimer(opts.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.deps, true, res.err
+	case <-timer.C:
+		return nil, false, nil
+	}
+}
+
+// With -require-all-repos a single repo blip fails the whole query, so the
+// query is retried as a whole, backing off a little more each time, up to
+// -query-retries times.
+func retryQuery(gems []string, opts queryOptions) ([]gemInfo, error) {
+	deps, err := depQuery(gems, opts)
+	backoff := queryRetryBackoffFlag
+	for attempt := 0; err != nil && err != errMaintenance && opts.requireAllRepos && attempt < queryRetriesFlag && !opts.expired(); attempt++ {
+		fmt.Printf("Dependency query failed, retrying in %s: %s\n", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		deps, err = depQuery(gems, opts)
+	}
+	return deps, err
+}
+
+// Orders deps by where their gem was in the request, keeping the merge's order
+// among versions of the same gem.
+func inRequestOrder(deps []gemInfo, gems []string) []gemInfo {
+	pos := make(map[string]int, len(gems))
+	for i, gem := range gems {
+		if _, ok := pos[gem]; !ok {
+			pos[gem] = i
+		}
+	}
+
+	sorted := append([]gemInfo(nil), deps...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return pos[sorted[i].Name] < pos[sorted[j].Name]
+	})
+	return sorted
+}
+
+// Estimates the encoded size of deps.
+func encodedSize(deps []gemInfo) int {
+	total := 0
+	for _, dep := range deps {
+		total += dep.size()
+	}
+	return total
+}
+
+// Returns how many of deps fit within max bytes once encoded.
+func fitSize(deps []gemInfo, max int) int {
+	total := 0
+	for i, dep := range deps {
+		total += dep.size()
+		if total > max {
+			return i
+		}
+	}
+	return len(deps)
+}
+
+// Keeps only the entries for the given platforms. Pure ruby gems work on every
+// platform so they're always kept.
+func filterPlatforms(deps []gemInfo, platforms []string) []gemInfo {
+	want := map[string]bool{"ruby": true}
+	for _, p := range platforms {
+		want[p] = true
+	}
+
+	var filtered []gemInfo
+	for _, dep := range deps {
+		if want[dep.Platform] {
+			filtered = append(filtered, dep)
+		}
+	}
+	return filtered
+}
+
 // Queries one or more remote repos for the dependency info on one or more gems.
 // Merges the results and returns them.
-func depQuery(gems []string) ([]gemInfo, error) {
+func depQuery(gems []string, opts queryOptions) ([]gemInfo, error) {
+	key := cacheKey(gems, opts)
+	if cacheTTLFlag > 0 && !opts.refresh {
+		if deps, stale, ok := depCache.get(key); ok {
+			opts.stats.cacheHit()
+			metrics.add(metricCacheHitBytes, float64(encodedSize(deps)))
+			updateGemDir(deps)
+			if stale && !offlineFlag {
+				revalidate(key, gems, opts)
+			}
+			return deps, nil
+		}
+	}
+	if maintenance.Load() {
+		return nil, errMaintenance
+	}
+	if coalesceWindowFlag > 0 && !opts.coalesced && !opts.refresh {
+		return coalesce(key, gems, opts)
+	}
+	if opts.merge == mergePriority && priorityShortCircuitFlag {
+		return shortCircuitQuery(key, gems, opts)
+	}
+	if primaryThenVerifyFlag && !opts.refresh {
+		return primaryQuery(key, gems, opts)
+	}
+
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	all := make([][]gemInfo, len(reposFlag))
+	pending := make(map[*repository]bool)
 	var repoErr error
+	// The gems asked of repos that answered with nothing at all.
+	empty := make(map[int][]string)
+
+	// Bounds the goroutines this one request can have running, so a large
+	// request can't starve others. The rest queue here.
+	fanout := len(reposFlag)
+	if maxRequestFanoutFlag > 0 && maxRequestFanoutFlag < fanout {
+		fanout = maxRequestFanoutFlag
+	}
+	slots := make(chan struct{}, fanout)
+
+	finished := make(chan struct{})
+	go func() {
+		for i, repo := range reposFlag {
+			repoGems := reposFlag.gemsFor(repo, gems)
+			if len(repoGems) == 0 {
+				continue
+			}
+
+			mu.Lock()
+			pending[repo] = true
+			mu.Unlock()
+
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, repo *repository) {
+				defer func() { <-slots }()
+				deps, err := queryRepo(repo, repoGems, opts)
+
+				mu.Lock()
+				delete(pending, repo)
+				if err != nil {
+					if !opts.requireAllRepos {
+						repo.logSkipped(err)
+					} else if repoErr == nil {
+						repoErr = err
+					}
+				} else {
+					all[i] = deps
+					if len(deps) == 0 {
+						empty[i] = repoGems
+					}
+				}
+				mu.Unlock()
+				wg.Done()
+			}(i, repo)
+		}
+		wg.Wait()
+		if warnEmptyFlag {
+			checkEmptyResponses(empty, all)
+		}
+		close(finished)
+	}()
 
+	var deadline <-chan time.Time
+	if repoSoftDeadlineFlag > 0 {
+		timer := time.NewTimer(repoSoftDeadlineFlag)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-finished:
+	case <-deadline:
+		// Answer with what the repos that made the deadline had to say. The
+		// slow ones carry on in the background, and once they're done the
+		// complete result is cached for the next request.
+		mu.Lock()
+		partial := append([][]gemInfo(nil), all...)
+		var slow []string
+		for repo := range pending {
+			slow = append(slow, repo.public())
+		}
+		err := repoErr
+		mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Printf("Responding without repos that missed the soft deadline, result is incomplete: %s\n", strings.Join(slow, ", "))
+		opts.partial.mark()
+		backgroundQueries.Add(1)
+		go func() {
+			defer backgroundQueries.Done()
+			<-finished
+			if repoErr == nil {
+				// The summary has already been sent.
+				opts := opts
+				opts.stats = nil
+				opts.timing = nil
+				opts.partial = nil
+				finishQuery(key, gems, all, opts)
+			}
+		}()
+
+		if len(fallbackReposFlag) > 0 {
+			partial = append(partial, queryFallbacks(gems, partial, opts)...)
+		}
+		deps := mergeDependencies(partial, opts)
+		updateGemDir(deps)
+		return deps, nil
+	}
+
+	if repoErr != nil {
+		return nil, repoErr
+	}
+
+	return finishQuery(key, gems, all, opts), nil
+}
+
+// Asks a repo about gems, recording how it went.
+func queryRepo(repo *repository, gems []string, opts queryOptions) ([]gemInfo, error) {
+	useRepoCache := repoCacheTTLFlag > 0 && !offlineFlag
+	if useRepoCache && !opts.refresh {
+		if deps, ok := getRepoCache(repo, gems); ok {
+			for _, gem := range gems {
+				tracef(gem, "repo %s answered from -repo-cache-ttl", repo.public())
+			}
+			opts.stats.repoResult(repo, len(deps))
+			return deps, nil
+		}
+	}
+
+	deps, err := loadDependencies(opts.context(), repo.withAliases(gems), repo)
+	deps = repo.canonicalize(deps)
+	traceResults(repo, gems, deps, err)
+	// A repo cut off by the query's timeout hasn't failed.
+	if !offlineFlag && !opts.expired() {
+		repo.recordResult(err)
+	}
+	if useRepoCache && err == nil {
+		setRepoCache(repo, gems, deps)
+	}
+	opts.stats.repoResult(repo, len(deps))
+	return deps, err
+}
+
+// With the priority merge, a gem is served entirely from the first repo that
+// has it, so once a repo has answered for a gem the repos after it needn't be
+// asked. The repos are asked one at a time in priority order, each about only
+// the gems still unresolved, trading latency for fewer upstream requests.
+func shortCircuitQuery(key string, gems []string, opts queryOptions) ([]gemInfo, error) {
+	all := make([][]gemInfo, len(reposFlag))
+	remaining := gems
 	for i, repo := range reposFlag {
+		repoGems := reposFlag.gemsFor(repo, remaining)
+		if len(repoGems) == 0 {
+			continue
+		}
+
+		deps, err := queryRepo(repo, repoGems, opts)
+		if err != nil {
+			if opts.requireAllRepos {
+				return nil, err
+			}
+			repo.logSkipped(err)
+			continue
+		}
+		all[i] = deps
+
+		// A gem is only resolved by versions the merge will keep.
+		resolved := make(map[string]bool)
+		for _, dep := range deps {
+			if opts.excludePrerelease && dep.prerelease() {
+				continue
+			}
+			if pin := reposFlag.pinned(dep.Name); pin != nil && pin != repo {
+				continue
+			}
+			resolved[dep.Name] = true
+		}
+		var next []string
+		for _, gem := range remaining {
+			if !resolved[gem] {
+				next = append(next, gem)
+			}
+		}
+		if len(next) < len(remaining) {
+			debugf("Resolved %d gems from %s, %d left to ask the remaining repos about", len(remaining)-len(next), repo.public(), len(next))
+		}
+		remaining = next
+		if len(remaining) == 0 {
+			break
+		}
+	}
+	return finishQuery(key, gems, all, opts), nil
+}
+
+// RubyGems only allows these characters in gem names.
+var validGemName = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// Splits a gems= value, already URL decoded, on commas. A comma can't be part
+// of a gem name, so an encoded %2C separates names just as a literal one does.
+// Empty names, as left by a trailing comma, are skipped, and anything else
+// that can't be a gem name is refused rather than asked of the repos.
+func splitGemNames(query string) ([]string, error) {
+	var gems []string
+	for _, gem := range strings.Split(query, ",") {
+		if normalizeGemNamesFlag {
+			gem = strings.ToLower(strings.TrimRight(gem, "/"))
+		}
+		if gem == "" {
+			continue
+		}
+		if !validGemName.MatchString(gem) {
+			return nil, fmt.Errorf("invalid gem name %q", gem)
+		}
+		gems = append(gems, gem)
+	}
+	return gems, nil
+}
+
+// Identical queries share one result while it's being fetched and for
+// -coalesce-window after, so an install storm asks the repos once rather than
+// once per client. Unlike the cache it applies whatever -cache-ttl is.
+var flights = struct {
+	sync.Mutex
+	queries map[string]*flight
+}{queries: make(map[string]*flight)}
+
+type flight struct {
+	done    chan struct{}
+	deps    []gemInfo
+	err     error
+	partial bool
+}
+
+func coalesce(key string, gems []string, opts queryOptions) ([]gemInfo, error) {
+	// The overrides are already part of the cache key, but the shared query
+	// runs under the first caller's timeout, which a caller allowed longer
+	// mustn't be held to.
+	key = fmt.Sprintf("%s timeout=%s", key, opts.timeout)
+
+	flights.Lock()
+	f, ok := flights.queries[key]
+	if !ok {
+		f = &flight{done: make(chan struct{})}
+		flights.queries[key] = f
+	}
+	flights.Unlock()
+
+	if ok {
+		<-f.done
+		if f.partial {
+			opts.partial.mark()
+		}
+		// Callers may reorder and filter what they're given.
+		return append([]gemInfo(nil), f.deps...), f.err
+	}
+
+	shared := opts
+	shared.coalesced = true
+	shared.partial = new(partialResult)
+	f.deps, f.err = depQuery(gems, shared)
+	f.partial = shared.partial.marked()
+	if f.partial {
+		opts.partial.mark()
+	}
+	close(f.done)
+
+	// Queries after a partial result should get the complete one, once
+	// it's cached, and queries after a failure should try again.
+	land := func() {
+		flights.Lock()
+		if flights.queries[key] == f {
+			delete(flights.queries, key)
+		}
+		flights.Unlock()
+	}
+	if f.partial || f.err != nil {
+		land()
+	} else {
+		time.AfterFunc(coalesceWindowFlag, land)
+	}
+	return append([]gemInfo(nil), f.deps...), f.err
+}
+
+// Answers from only the first repo each gem may be asked of, then queries
+// every repo in the background and reports what the quick answer missed. The
+// complete result is what gets cached.
+func primaryQuery(key string, gems []string, opts queryOptions) ([]gemInfo, error) {
+	primary := make(map[int][]string)
+	for _, gem := range gems {
+		for i, repo := range reposFlag {
+			if len(reposFlag.gemsFor(repo, []string{gem})) > 0 {
+				primary[i] = append(primary[i], gem)
+				break
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	all := make([][]gemInfo, len(reposFlag))
+	var repoErr error
+	for i, repoGems := range primary {
 		wg.Add(1)
-		go func(i int) {
-			deps, err := loadDependencies(gems, repo)
+		go func(i int, repoGems []string) {
+			defer wg.Done()
+			deps, err := queryRepo(reposFlag[i], repoGems, opts)
 
 			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				if repoErr == nil {
+				if !opts.requireAllRepos {
+					reposFlag[i].logSkipped(err)
+				} else if repoErr == nil {
 					repoErr = err
 				}
-			} else {
-				all[i] = deps
+				return
 			}
-			mu.Unlock()
-			wg.Done()
-		}(i)
+			all[i] = deps
+		}(i, repoGems)
 	}
-
 	wg.Wait()
-
 	if repoErr != nil {
 		return nil, repoErr
 	}
 
-	deps := mergeDependencies(all)
+	if len(fallbackReposFlag) > 0 {
+		all = append(all, queryFallbacks(gems, all, opts)...)
+	}
+	fast := mergeDependencies(all, opts)
+	updateGemDir(fast)
+	opts.partial.mark()
+
+	verify := opts
+	verify.stats = nil
+	verify.timing = nil
+	verify.partial = nil
+	verify.ctx = nil
+	verify.refresh = true
+	backgroundQueries.Add(1)
+	go func() {
+		defer backgroundQueries.Done()
+		full, err := depQuery(gems, verify)
+		if err != nil {
+			fmt.Println("Failed to verify primary result:", err)
+			return
+		}
+		served := make(map[string]bool, len(fast))
+		for i := range fast {
+			served[fast[i].ident()] = true
+		}
+		for i := range full {
+			if !served[full[i].ident()] {
+				metrics.add(metricPrimaryMissed, 1, full[i].repo.public())
+				fmt.Printf("Warning: primary result left out %s, which %s has\n", full[i].ident(), full[i].repo.public())
+			}
+		}
+	}()
+
+	return fast, nil
+}
+
+// A repo answering with nothing, when another repo has some of the same gems,
+// may just not carry them. But for a mirror that should have everything it
+// usually means the mirror is broken and answering empty.
+func checkEmptyResponses(empty map[int][]string, all [][]gemInfo) {
+	for i, gems := range empty {
+		asked := make(map[string]bool)
+		for _, gem := range gems {
+			asked[gem] = true
+		}
+
+		var elsewhere []string
+		seen := make(map[string]bool)
+		for j, deps := range all {
+			if j == i {
+				continue
+			}
+			for _, dep := range deps {
+				if asked[dep.Name] && !seen[dep.Name] {
+					seen[dep.Name] = true
+					elsewhere = append(elsewhere, dep.Name)
+				}
+			}
+		}
+
+		if len(elsewhere) > 0 {
+			metrics.add(metricSuspectEmptyResponses, 1, reposFlag[i].public())
+			fmt.Printf("Warning: repo %s answered with nothing, though other repos have %s\n", reposFlag[i].public(), strings.Join(elsewhere, ", "))
+		}
+	}
+}
+
+// Cache keys with a refresh under way, so a popular stale entry is only
+// refreshed once.
+var (
+	revalidating     = make(map[string]bool)
+	revalidatingLock sync.Mutex
+)
+
+// Refreshes a stale cache entry in the background, for the next request.
+func revalidate(key string, gems []string, opts queryOptions) {
+	revalidatingLock.Lock()
+	defer revalidatingLock.Unlock()
+	if revalidating[key] {
+		return
+	}
+	revalidating[key] = true
+
+	opts.stats = nil
+	opts.timing = nil
+	opts.ctx = nil
+	opts.refresh = true
+	backgroundQueries.Add(1)
+	go func() {
+		defer backgroundQueries.Done()
+		if _, err := depQuery(gems, opts); err != nil {
+			fmt.Println("Failed to refresh stale cache entry:", err)
+		}
+		revalidatingLock.Lock()
+		delete(revalidating, key)
+		revalidatingLock.Unlock()
+	}()
+}
+
+// Merges a complete set of repo results, recording where each gem lives and
+// caching the result.
+func finishQuery(key string, gems []string, all [][]gemInfo, opts queryOptions) []gemInfo {
+	if len(fallbackReposFlag) > 0 {
+		all = append(all, queryFallbacks(gems, all, opts)...)
+	}
+	deps := mergeDependencies(all, opts)
 	updateGemDir(deps)
-	return deps, nil
+	// What's missing offline may well be there once the repos are back, as
+	// may a wholesale empty result -strict-empty-merge refuses to serve, or
+	// the repos that were still answering when the query timed out.
+	refused := strictEmptyMergeFlag && len(gems) > 1 && len(deps) == 0
+	if ttl := cacheTTLFor(gems); cacheTTLFlag > 0 && ttl > 0 && !offlineFlag && !refused && !opts.expired() {
+		depCache.set(key, gems, deps, ttl)
+	}
+	return deps
+}
+
+// Asks the fallback repos, in turn, about the gems no primary repo had. A
+// failing fallback is only logged, since the primaries have already answered.
+func queryFallbacks(gems []string, all [][]gemInfo, opts queryOptions) [][]gemInfo {
+	found := make(map[string]bool)
+	for _, deps := range all {
+		for _, dep := range deps {
+			found[dep.Name] = true
+		}
+	}
+
+	var results [][]gemInfo
+	for _, repo := range fallbackReposFlag {
+		// Gems routed to a primary repo stay there, so a private gem's name
+		// never reaches a public fallback.
+		var missing []string
+		for _, gem := range gems {
+			if !found[gem] && !reposFlag.claimed(gem) {
+				missing = append(missing, gem)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+
+		deps, err := loadDependencies(opts.context(), repo.withAliases(missing), repo)
+		deps = repo.canonicalize(deps)
+		traceResults(repo, missing, deps, err)
+		opts.stats.repoResult(repo, len(deps))
+		if err != nil {
+			fmt.Printf("Skipping fallback repo %s: %s\n", repo.public(), err)
+			continue
+		}
+		for _, dep := range deps {
+			found[dep.Name] = true
+		}
+		results = append(results, deps)
+	}
+	return results
+}
+
+// Compares dependency lists regardless of the order the repos listed them in.
+func sameDependencies(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	key := func(deps [][]string) []string {
+		out := make([]string, len(deps))
+		for i, dep := range deps {
+			out[i] = strings.Join(dep, "\x00")
+		}
+		sort.Strings(out)
+		return out
+	}
+	ka, kb := key(a), key(b)
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Logs what a repo said about any of the traced gems.
+func traceResults(repo *repository, gems []string, deps []gemInfo, err error) {
+	if len(traceGemFlag) == 0 {
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, dep := range deps {
+		found[dep.Name] = true
+		tracef(dep.Name, "repo %s has %s with dependencies %v", repo.public(), dep.ident(), dep.Dependencies)
+	}
+	for _, gem := range gems {
+		if err != nil {
+			tracef(gem, "repo %s failed: %s", repo.public(), err)
+		} else if !found[gem] {
+			tracef(gem, "repo %s has no versions", repo.public())
+		}
+	}
+}
+
+// Some upstreams cap how many gems they'll process per request and silently
+// answer for only a subset. Re-request the missing names for as long as each
+// follow-up keeps turning up gems, so that a name the repo genuinely doesn't
+// have costs at most one extra request.
+func loadDependencies(ctx context.Context, deps []string, repo *repository) ([]gemInfo, error) {
+	if snapshotModeFlag == snapshotServe {
+		return loadSnapshot(repo, deps)
+	}
+	// Offline, whatever was captured is all there is.
+	if offlineFlag {
+		if snapshotDirFlag != "" {
+			return loadSnapshot(repo, deps)
+		}
+		return nil, nil
+	}
+
+	requested := deps
+	results, err := fetchDependencies(ctx, deps, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := missingNames(deps, results)
+	for i := 0; i < shortfallRetriesFlag && len(missing) > 0 && len(missing) < len(deps); i++ {
+		more, err := fetchDependencies(ctx, missing, repo)
+		if err != nil {
+			return nil, err
+		}
+		if len(more) == 0 {
+			break
+		}
+		fmt.Printf("Repo %s answered for %d of %d gems, fetched %d more\n", repo.public(), len(deps)-len(missing), len(deps), len(more))
+		results = append(results, more...)
+		deps, missing = missing, missingNames(missing, more)
+	}
+
+	results = dedupe(results, repo)
+
+	if snapshotModeFlag == snapshotCapture {
+		if err := captureSnapshot(repo, requested, results); err != nil {
+			fmt.Printf("Failed to capture snapshot for repo %s: %s\n", repo.public(), err)
+		}
+	}
+
+	return results, nil
+}
+
+// A buggy upstream may list the same gem more than once. Keeps the first.
+func dedupe(results []gemInfo, repo *repository) []gemInfo {
+	seen := make(map[string]bool)
+	out := results[:0]
+	for _, dep := range results {
+		if seen[dep.ident()] {
+			debugf("Dropping duplicate %s from repo %s", dep.ident(), repo.public())
+			continue
+		}
+		seen[dep.ident()] = true
+		out = append(out, dep)
+	}
+	if dropped := len(results) - len(out); dropped > 0 {
+		fmt.Printf("Repo %s listed %d gems more than once\n", repo.public(), dropped)
+	}
+	return out
+}
+
+// The decoder fills in the slice as it goes, so a failed decode leaves the
+// entries read before the failure intact and the rest zeroed. The last entry
+// with anything in it may have been cut short after its name and version,
+// missing dependencies, so it's dropped too. Returns the intact prefix.
+func decodedPrefix(results []gemInfo) []gemInfo {
+	n := len(results)
+	for i, dep := range results {
+		if dep.Name == "" || dep.Version == "" {
+			n = i
+			break
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return results[:n-1]
+}
+
+// Returns the requested names that have no entries in results.
+func missingNames(requested []string, results []gemInfo) []string {
+	found := make(map[string]bool)
+	for _, dep := range results {
+		found[dep.Name] = true
+	}
+
+	var missing []string
+	for _, name := range requested {
+		if !found[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
 }
 
-func loadDependencies(deps []string, repo *url.URL) ([]gemInfo, error) {
-	u := repo.ResolveReference(&url.URL{Path: ""})
-	u.Query().Add("gems", strings.Join(deps, ","))
-	res, err := http.Get(fmt.Sprintf("%s%s?gems=%s", repo, "api/v1/dependencies", url.QueryEscape(strings.Join(deps, ","))))
+func fetchDependencies(ctx context.Context, deps []string, repo *repository) ([]gemInfo, error) {
+	start := time.Now()
+	defer func() {
+		if d := time.Since(start); slowUpstreamThresholdFlag > 0 && d > slowUpstreamThresholdFlag {
+			fmt.Printf("Warning: slow response from repo %s, %d gems took %s\n", repo.public(), len(deps), d)
+		}
+	}()
+
+	u := repo.endpoint(repo.depsPath)
+	q := u.Query()
+	for k, vs := range repo.params {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	q.Set("gems", strings.Join(deps, ","))
+	u.RawQuery = q.Encode()
+
+	if err := acquireUpstream(ctx, repo); err != nil {
+		return nil, fmt.Errorf("query timed out waiting to ask repo %s", repo.public())
+	}
+	defer releaseUpstream(repo)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	accept := upstreamAcceptFlag
+	if repo.accept != "" {
+		accept = repo.accept
+	}
+	req.Header.Set("Accept", accept)
+	if repo.timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), repo.timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	res, err := upstreamClient.Do(req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("query timed out before repo %s answered", repo.public())
+		}
+		if req.Context().Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("repo %s didn't answer within its timeout of %s", repo.public(), repo.timeout)
+		}
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	r := rmarsh.NewDecoder(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("repo %s responded %s", repo.public(), res.Status)
+	}
+	// A dependencies API redirecting elsewhere is usually sending an
+	// unauthenticated client to a login page, which is better said plainly
+	// than left to fail decoding.
+	if final := res.Request.URL; !allowDepsRedirectsFlag && (final.Host != u.Host || final.Path != u.Path) {
+		return nil, fmt.Errorf("repo %s redirected its dependencies API to %s, check its credentials", repo.public(), redactURL(final))
+	}
+
+	// A misconfigured upstream may answer 200 with an HTML error page, which
+	// must not be mistaken for a repo that has none of the gems.
+	body := bufio.NewReader(res.Body)
+	magic, err := body.Peek(2)
+	if err != nil || magic[0] != 4 {
+		return nil, fmt.Errorf("repo %s did not respond with marshal data (Content-Type %q)", repo.public(), res.Header.Get("Content-Type"))
+	}
+	if magic[1] != 8 {
+		return nil, fmt.Errorf("repo %s responded with marshal format %d.%d, only 4.8 can be decoded", repo.public(), magic[0], magic[1])
+	}
+
+	r := rmarsh.NewDecoder(body)
 	var results []gemInfo
 	if err := r.Decode(&results); err != nil {
-		return nil, err
+		if !toleratePartialDecodeFlag {
+			return nil, err
+		}
+		results = decodedPrefix(results)
+		if len(results) == 0 {
+			return nil, err
+		}
+		fmt.Printf("Warning: malformed response from repo %s, keeping the %d gems decoded before: %s\n", repo.public(), len(results), err)
 	}
 
+	modified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
 	for i := range results {
 		results[i].repo = repo
+		results[i].modified = modified
+		// Some upstreams leave the platform out for pure ruby gems.
+		if results[i].Platform == "" {
+			results[i].Platform = "ruby"
+		}
+		// Real gems have tens of dependencies at most, so many more points
+		// at broken or hostile data, which every merge and encode pays for.
+		if n := len(results[i].Dependencies); maxDependenciesFlag > 0 && n > maxDependenciesFlag {
+			fmt.Printf("Warning: %s from repo %s has %d dependencies, over -max-dependencies of %d\n", results[i].ident(), repo.public(), n, maxDependenciesFlag)
+			if maxDependenciesPolicyFlag == "truncate" {
+				results[i].Dependencies = results[i].Dependencies[:maxDependenciesFlag]
+			}
+		}
 	}
 
 	return results, nil
 }
 
 // Merges together multiple dep lists in priority order.
-func mergeDependencies(deps [][]gemInfo) []gemInfo {
-	var merged []gemInfo
-	seen := make(map[string]bool)
+func mergeDependencies(deps [][]gemInfo, opts queryOptions) []gemInfo {
+	start := time.Now()
+	defer func() { opts.timing.add("merge", "Merging repo responses", time.Since(start)) }()
+	// Merges can run to tens of thousands of versions, so size everything up
+	// front rather than growing it one gem at a time.
+	total := 0
+	for _, rdeps := range deps {
+		total += len(rdeps)
+	}
+	merged := make([]gemInfo, 0, total)
+	seen := make(map[string]int, total)
+	owner := make(map[string]*repository)
 
 	for _, rdeps := range deps {
 		for _, dep := range rdeps {
-			if _, ok := seen[dep.ident()]; ok {
+			if opts.excludePrerelease && dep.prerelease() {
+				tracef(dep.Name, "%s from %s excluded as a prerelease", dep.ident(), dep.repo.public())
+				continue
+			}
+			if pin := reposFlag.pinned(dep.Name); pin != nil && pin != dep.repo {
+				tracef(dep.Name, "%s from %s excluded, pinned to %s", dep.ident(), dep.repo.public(), pin.public())
+				continue
+			}
+			if opts.merge == mergePriority {
+				if o, ok := owner[dep.Name]; ok && o != dep.repo {
+					tracef(dep.Name, "%s from %s excluded, %s is served by %s", dep.ident(), dep.repo.public(), dep.Name, o.public())
+					continue
+				}
+				owner[dep.Name] = dep.repo
+			}
+			ident := dep.ident()
+			if idx, ok := seen[ident]; ok {
+				kept, shadowed := merged[idx], dep
+				if preferVersion(&dep, &kept) {
+					kept, shadowed = dep, merged[idx]
+					kept.mirrors = append(append([]*repository(nil), shadowed.mirrors...), shadowed.repo)
+					debugf("%s from %s preferred to %s by -version-strategy=%s", ident, kept.repo.public(), shadowed.repo.public(), versionStrategyFlag)
+				} else {
+					kept.mirrors = append(kept.mirrors, shadowed.repo)
+				}
+				merged[idx] = kept
+
+				winner := kept.repo
+				metrics.add(metricShadowedGems, 1, winner.public(), shadowed.repo.public())
+				opts.stats.shadowed()
+				// The same version should have the same dependencies
+				// everywhere. When it doesn't, one of the repos is usually
+				// a mirror that's out of sync.
+				if !sameDependencies(kept.Dependencies, shadowed.Dependencies) {
+					metrics.add(metricDivergentDependencies, 1, winner.public(), shadowed.repo.public())
+					debugf("%s has dependencies %v in %s but %v in %s, using %s's", ident, kept.Dependencies, winner.public(), shadowed.Dependencies, shadowed.repo.public(), winner.public())
+				}
+				debugf("%s from %s is shadowed by %s", ident, shadowed.repo.public(), winner.public())
+				tracef(dep.Name, "%s from %s shadowed by %s", ident, shadowed.repo.public(), winner.public())
 				continue
 			}
-			seen[dep.ident()] = true
+			tracef(dep.Name, "%s served from %s", ident, dep.repo.public())
+			seen[ident] = len(merged)
 			merged = append(merged, dep)
 		}
 	}
@@ -0,0 +1,1393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samcday/rmarsh"
+)
+
+func idents(deps []gemInfo) []string {
+	var out []string
+	for _, dep := range deps {
+		out = append(out, dep.ident())
+	}
+	return out
+}
+
+func TestMergeHeaderOverride(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"), gem("rack", "2.0.0"))
+	configure(t, "-allow-overrides", "merge", "-repo", first.URL, "-repo", second.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack"), "", "X-Amalgemate-Merge", "priority")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-1.0.0"}) {
+		t.Errorf("with the override got %v", got)
+	}
+
+	// The next request without the header gets the default union again.
+	w = request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0"}) {
+		t.Errorf("without the override got %v", got)
+	}
+}
+
+func TestDisallowedOverrideIgnored(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0.beta"))
+	configure(t, "-allow-overrides", "merge", "-repo", first.URL, "-repo", second.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack"), "", "X-Amalgemate-Exclude-Prerelease", "true", "X-Amalgemate-Merge", "bogus")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0.beta"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestJSONDependenciesSource(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0", "thor >= 1"))
+	second := newFakeRepo(t, gem("rails", "7.0.0"))
+	configure(t, "-repo", first.URL, "-repo", second.URL)
+
+	w := request(handleDependenciesJSON, "GET", "/api/v1/dependencies.json?gems=rack,rails", "")
+	var got []struct {
+		Name         string     `json:"name"`
+		Source       string     `json:"source"`
+		GemURI       string     `json:"gem_uri"`
+		Dependencies [][]string `json:"dependencies"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%s: %s", err, w.Body)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	if got[0].Source != first.URL || got[0].GemURI != first.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("rack from %s at %s", got[0].Source, got[0].GemURI)
+	}
+	if got[1].Source != second.URL {
+		t.Errorf("rails from %s", got[1].Source)
+	}
+	if len(got[0].Dependencies) != 1 {
+		t.Errorf("rack has dependencies %v", got[0].Dependencies)
+	}
+
+	w = request(handleDependenciesJSON, "GET", "/api/v1/dependencies.json?gems=rack&dependencies=false", "")
+	if strings.Contains(w.Body.String(), `"dependencies"`) {
+		t.Errorf("dependencies=false still sent them: %s", w.Body)
+	}
+}
+
+func TestJSONDependenciesSourceRedacted(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	u, _ := url.Parse(repo.URL)
+	u.User = url.UserPassword("user", "secret")
+	configure(t, "-repo", u.String())
+
+	w := request(handleDependenciesJSON, "GET", "/api/v1/dependencies.json?gems=rack", "")
+	if strings.Contains(w.Body.String(), "secret") {
+		t.Errorf("credentials leaked: %s", w.Body)
+	}
+}
+
+func TestShortfallRetries(t *testing.T) {
+	repo := newFakeRepo(t, gem("a", "1.0.0"), gem("b", "1.0.0"), gem("c", "1.0.0"), gem("d", "1.0.0"))
+	repo.limit = 2
+	configure(t, "-shortfall-retries", "3", "-repo", repo.URL)
+
+	deps, err := depQuery([]string{"a", "b", "c", "d", "missing"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 4 {
+		t.Errorf("got %v", idents(deps))
+	}
+	// The missing gem costs one extra request, which turns up nothing.
+	asked := repo.asked()
+	want := [][]string{{"a", "b", "c", "d", "missing"}, {"c", "d", "missing"}, {"missing"}}
+	if len(asked) != len(want) {
+		t.Fatalf("asked %v", asked)
+	}
+	for i := range want {
+		if !equalStrings(asked[i], want[i]) {
+			t.Errorf("request %d asked %v, want %v", i, asked[i], want[i])
+		}
+	}
+}
+
+func TestNoShortfallRetriesByDefault(t *testing.T) {
+	repo := newFakeRepo(t, gem("a", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+
+	if _, err := depQuery([]string{"a", "missing"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(repo.asked()); n != 1 {
+		t.Errorf("asked %d times, want once", n)
+	}
+}
+
+func TestCacheHeadersAndNotModified(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-cache-ttl", "90s", "-repo", repo.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := w.Header().Get("Cache-Control"); got != "public, max-age=90" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	w = request(handleDependencies, "GET", dependencies("rack"), "", "If-None-Match", etag)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	w = request(handleDependencies, "GET", dependencies("rack"), "", "If-None-Match", `"other"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != etag {
+		t.Errorf("got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestNoCacheHeadersWithoutTTL(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if w.Header().Get("Cache-Control") != "" || w.Header().Get("ETag") != "" {
+		t.Errorf("got headers %v", w.Header())
+	}
+}
+
+func TestPartialDecode(t *testing.T) {
+	body := encodeDeps([]gemInfo{gem("a", "1.0.0"), gem("b", "1.0.0"), gem("c", "1.0.0", "rack >= 1")})
+	repo := newFakeRepo(t)
+	// Cut off partway through the last gem, after its name and version.
+	repo.body = body[:len(body)-4]
+
+	configure(t, "-repo", repo.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"a", "b", "c"}, repo.repo()); err == nil {
+		t.Error("truncated response decoded without -tolerate-partial-decode")
+	}
+
+	configure(t, "-tolerate-partial-decode", "-repo", repo.URL)
+	deps, err := fetchDependencies(context.Background(), []string{"a", "b", "c"}, repo.repo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"a-1.0.0", "b-1.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+
+	// Cut off as the last gem starts, there's no telling that b was read in
+	// full, so it goes as well.
+	repo.body = body[:bytes.LastIndex(body, []byte("\"\x06c"))]
+	deps, err = fetchDependencies(context.Background(), []string{"a", "b", "c"}, repo.repo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"a-1.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+
+	// Nothing decoded is still a failure.
+	repo.body = body[:4]
+	if _, err := fetchDependencies(context.Background(), []string{"a", "b", "c"}, repo.repo()); err == nil {
+		t.Error("response with nothing decodable didn't fail")
+	}
+}
+
+func TestShadowingMetrics(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0", "thor >= 1"))
+	second := newFakeRepo(t, gem("rack", "1.0.0", "thor >= 2"), gem("rack", "2.0.0"))
+	m := configure(t, "-repo", first.URL, "-repo", second.URL)
+
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+	if deps[0].repo != first.repo() || len(deps[0].mirrors) != 1 || deps[0].mirrors[0] != second.repo() {
+		t.Errorf("rack-1.0.0 from %s with mirrors %v", deps[0].repo.public(), publicRepos(deps[0].mirrors))
+	}
+	if n := m.count(metricShadowedGems, first.URL, second.URL); n != 1 {
+		t.Errorf("counted %v shadowed gems", n)
+	}
+	if n := m.count(metricDivergentDependencies, first.URL, second.URL); n != 1 {
+		t.Errorf("counted %v divergent dependencies", n)
+	}
+}
+
+func TestPlatformsFilter(t *testing.T) {
+	java := gem("nokogiri", "1.0.0")
+	java.Platform = "java"
+	linux := gem("nokogiri", "1.0.0")
+	linux.Platform = "x86_64-linux"
+	repo := newFakeRepo(t, gem("nokogiri", "1.0.0"), java, linux)
+	configure(t, "-repo", repo.URL)
+
+	w := request(handleDependencies, "GET", dependencies("nokogiri")+"&platforms=x86_64-linux", "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"nokogiri-1.0.0", "nokogiri-1.0.0-x86_64-linux"}) {
+		t.Errorf("got %v", got)
+	}
+
+	w = request(handleDependencies, "GET", dependencies("nokogiri"), "")
+	if got := decodeDeps(t, w.Body.Bytes()); len(got) != 3 {
+		t.Errorf("unfiltered got %v", idents(got))
+	}
+}
+
+func TestMaxMergedBytes(t *testing.T) {
+	var gems []gemInfo
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0", "4.0.0"} {
+		gems = append(gems, gem("rack", v))
+	}
+	repo := newFakeRepo(t, gems...)
+	budget := fmt.Sprint(2*gems[0].size() + 1)
+
+	configure(t, "-max-merged-bytes", budget, "-repo", repo.URL)
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("with the error policy got %d", w.Code)
+	}
+
+	configure(t, "-max-merged-bytes", budget, "-max-merged-policy", "truncate", "-repo", repo.URL)
+	w = request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := decodeDeps(t, w.Body.Bytes()); len(got) != 2 || w.Header().Get("X-Amalgemate-Truncated") != "2" {
+		t.Errorf("with the truncate policy got %v, X-Amalgemate-Truncated %q", idents(got), w.Header().Get("X-Amalgemate-Truncated"))
+	}
+
+	configure(t, "-max-merged-bytes", budget, "-max-merged-policy", "stream", "-repo", repo.URL)
+	w = request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := decodeDeps(t, w.Body.Bytes()); len(got) != 4 {
+		t.Errorf("with the stream policy got %v", idents(got))
+	}
+}
+
+func TestMaxMergedStreamSkipsBuffer(t *testing.T) {
+	var gems []gemInfo
+	for _, v := range []string{"1.0.0", "2.0.0", "3.0.0"} {
+		gems = append(gems, gem("rack", v))
+	}
+	repo := newFakeRepo(t, gems...)
+	budget := fmt.Sprint(gems[0].size() + 1)
+	configure(t, "-cache-ttl", "1h", "-max-merged-bytes", budget, "-max-merged-policy", "stream", "-repo", repo.URL)
+
+	// Buffered responses carry an ETag, worked out from the whole body.
+	for _, c := range []struct {
+		h      http.HandlerFunc
+		target string
+	}{
+		{handleDependencies, dependencies("rack")},
+		{handleDependenciesJSON, "/api/v1/dependencies.json?gems=rack"},
+	} {
+		w := request(c.h, "GET", c.target, "")
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != "" {
+			t.Errorf("%s got %d with ETag %q", c.target, w.Code, w.Header().Get("ETag"))
+		}
+	}
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if got := decodeDeps(t, w.Body.Bytes()); len(got) != 3 {
+		t.Errorf("streamed %v", idents(got))
+	}
+
+	// Those within the budget are still buffered.
+	w = request(handleDependencies, "GET", dependencies("missing"), "")
+	if w.Header().Get("ETag") == "" {
+		t.Error("small response streamed")
+	}
+}
+
+func TestSkipEncodeOnDisconnect(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", dependencies("rack"), nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	handleDependencies(w, r)
+
+	if w.Body.Len() != 0 || w.Header().Get("Content-Type") != "" {
+		t.Errorf("encoded %d bytes for a client that went away", w.Body.Len())
+	}
+}
+
+func TestSlowUpstreamLogged(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(50 * time.Millisecond)
+	configure(t, "-slow-upstream-threshold", "10ms", "-repo", repo.URL)
+
+	out := captureOutput(t, func() {
+		if _, err := depQuery([]string{"rack", "rails"}, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if !strings.Contains(out, "slow response from repo "+repo.URL+", 2 gems took") {
+		t.Errorf("logged %q", out)
+	}
+
+	repo.setLatency(0)
+	configure(t, "-slow-upstream-threshold", "1s", "-repo", repo.URL)
+	out = captureOutput(t, func() {
+		depQuery([]string{"rack"}, defaultOptions())
+	})
+	if strings.Contains(out, "slow response") {
+		t.Errorf("fast response logged: %q", out)
+	}
+}
+
+func TestPinnedGem(t *testing.T) {
+	public := newFakeRepo(t, gem("internal-auth", "9.9.9"), gem("rack", "1.0.0"))
+	private := newFakeRepo(t, gem("internal-auth", "1.0.0"))
+	configure(t, "-repo", public.URL, "-repo", private.URL+",pin=internal-*")
+
+	for _, merge := range []string{mergeUnion, mergePriority} {
+		opts := defaultOptions()
+		opts.merge = merge
+		deps, err := depQuery([]string{"internal-auth", "rack"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := served(deps); !equalStrings(got, []string{"rack-1.0.0@" + public.URL, "internal-auth-1.0.0@" + private.URL}) {
+			t.Errorf("%s merge got %v", merge, got)
+		}
+	}
+}
+
+// Six repos, slow enough that their requests overlap when allowed to, all
+// counted by one gauge.
+func slowRepos(t *testing.T) (*gauge, []string) {
+	g := &gauge{}
+	var args []string
+	for i := 0; i < 6; i++ {
+		repo := newFakeRepo(t, gem("rack", "1.0.0"))
+		repo.inFlight = g
+		repo.setLatency(20 * time.Millisecond)
+		args = append(args, "-repo", repo.URL)
+	}
+	return g, args
+}
+
+func TestMaxRequestFanout(t *testing.T) {
+	g, args := slowRepos(t)
+	configure(t, append([]string{"-max-request-fanout", "2"}, args...)...)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if n := g.peak(); n != 2 {
+		t.Errorf("%d repos asked at once, want 2", n)
+	}
+}
+
+func TestMaxUpstreamRequests(t *testing.T) {
+	g, args := slowRepos(t)
+	configure(t, append([]string{"-max-upstream-requests", "3"}, args...)...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			opts := defaultOptions()
+			opts.refresh = true
+			depQuery([]string{"rack"}, opts)
+		}()
+	}
+	wg.Wait()
+	if n := g.peak(); n != 3 {
+		t.Errorf("%d upstream requests at once, want 3", n)
+	}
+}
+
+func TestEncodeFailureIsClean500(t *testing.T) {
+	configure(t)
+	w := httptest.NewRecorder()
+	// Nothing marshal can represent.
+	writeMarshal(w, httptest.NewRequest("GET", dependencies("rack"), nil), []func(){func() {}}, false)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d", w.Code)
+	}
+	if bytes.HasPrefix(w.Body.Bytes(), []byte{4, 8}) {
+		t.Errorf("partial marshal stream sent: %q", w.Body)
+	}
+}
+
+func TestRoutedGemsSkipOtherRepos(t *testing.T) {
+	public := newFakeRepo(t, gem("rack", "1.0.0"), gem("mycorp-auth", "6.6.6"))
+	private := newFakeRepo(t, gem("mycorp-auth", "1.0.0"))
+	configure(t, "-repo", private.URL+",route=mycorp-*", "-repo", public.URL)
+
+	deps, err := depQuery([]string{"rack", "mycorp-auth"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(deps); !equalStrings(got, []string{"mycorp-auth-1.0.0@" + private.URL, "rack-1.0.0@" + public.URL}) {
+		t.Errorf("got %v", got)
+	}
+	for _, asked := range public.asked() {
+		if !equalStrings(asked, []string{"rack"}) {
+			t.Errorf("public repo asked about %v", asked)
+		}
+	}
+	for _, asked := range private.asked() {
+		if !equalStrings(asked, []string{"mycorp-auth"}) {
+			t.Errorf("private repo asked about %v", asked)
+		}
+	}
+}
+
+func TestRoutedGemsNeverReachPublicRepos(t *testing.T) {
+	public := newFakeRepo(t, gem("rack", "1.0.0"))
+	fallback := newFakeRepo(t, gem("mycorp-billing", "6.6.6"))
+	private := newFakeRepo(t, gem("mycorp-auth", "1.0.0"))
+	private.serveFile("gems/mycorp-auth-1.0.0.gem", []byte("private"))
+	configure(t, "-repo", private.URL+",route=mycorp-*", "-repo", public.URL, "-fallback-repo", fallback.URL)
+
+	// mycorp-billing is in no private repo, but still mustn't be asked of
+	// the fallback.
+	deps, err := depQuery([]string{"rack", "mycorp-auth", "mycorp-billing"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"mycorp-auth-1.0.0", "rack-1.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+	if asked := fallback.asked(); len(asked) != 0 {
+		t.Errorf("fallback asked about %v", asked)
+	}
+
+	// Nor are downloads probed for in public repos.
+	n := public.requestCount()
+	for _, file := range []string{"mycorp-auth-1.0.0.gem", "mycorp-billing-1.0.0.gem"} {
+		request(handleGem, "GET", "/gems/"+file, "")
+	}
+	if public.requestCount() != n {
+		t.Errorf("public repo asked for %s", public.lastRequest().URL.Path)
+	}
+}
+
+func TestGemsFor(t *testing.T) {
+	private := mustParseRepo(t, "https://private.example.com/,route=mycorp-*")
+	public := mustParseRepo(t, "https://public.example.com/")
+	rs := repos{private, public}
+
+	if got := rs.gemsFor(private, []string{"rack", "mycorp-a"}); !equalStrings(got, []string{"mycorp-a"}) {
+		t.Errorf("private asked %v", got)
+	}
+	if got := rs.gemsFor(public, []string{"rack", "mycorp-a"}); !equalStrings(got, []string{"rack"}) {
+		t.Errorf("public asked %v", got)
+	}
+}
+
+func TestDuplicateEntriesDropped(t *testing.T) {
+	repo := newFakeRepo(t)
+	repo.body = encodeDeps([]gemInfo{
+		gem("rack", "1.0.0", "thor >= 1"),
+		gem("rack", "2.0.0"),
+		gem("rack", "1.0.0", "rake >= 1"),
+	})
+	configure(t, "-repo", repo.URL)
+
+	deps, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0"}) {
+		t.Fatalf("got %v", got)
+	}
+	if d := deps[0].Dependencies; len(d) != 1 || d[0][0] != "thor" {
+		t.Errorf("kept %v, not the first listing", d)
+	}
+}
+
+func TestSoftDeadline(t *testing.T) {
+	fast := newFakeRepo(t, gem("rack", "1.0.0"))
+	slow := newFakeRepo(t, gem("rack", "2.0.0"))
+	slow.setLatency(200 * time.Millisecond)
+	fallback := newFakeRepo(t, gem("thor", "1.0.0"))
+	configure(t, "-cache-ttl", "1h", "-repo-soft-deadline", "20ms", "-repo", fast.URL, "-repo", slow.URL, "-fallback-repo", fallback.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack", "thor"), "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-1.0.0", "thor-1.0.0"}) {
+		t.Errorf("partial result %v", got)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("partial result sent with Cache-Control %q", cc)
+	}
+	if w.Header().Get("ETag") != "" {
+		t.Error("partial result sent with an ETag")
+	}
+
+	// The slow repo's answer completes the cached result.
+	key := cacheKey([]string{"rack", "thor"}, defaultOptions())
+	eventually(t, func() bool {
+		_, _, ok := depCache.get(key)
+		return ok
+	})
+	deps, _, _ := depCache.get(key)
+	if got := idents(deps); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0", "thor-1.0.0"}) {
+		t.Errorf("cached %v", got)
+	}
+	w = request(handleDependencies, "GET", dependencies("rack", "thor"), "")
+	if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "public") {
+		t.Errorf("complete result sent with Cache-Control %q", cc)
+	}
+}
+
+func TestSoftDeadlineCoalesced(t *testing.T) {
+	fast := newFakeRepo(t, gem("rack", "1.0.0"))
+	slow := newFakeRepo(t, gem("rack", "2.0.0"))
+	slow.setLatency(200 * time.Millisecond)
+	configure(t, "-cache-ttl", "1h", "-coalesce-window", "1m", "-repo-soft-deadline", "20ms", "-repo", fast.URL, "-repo", slow.URL)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 3)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = request(handleDependencies, "GET", dependencies("rack"), "")
+		}(i)
+	}
+	wg.Wait()
+	for _, w := range responses {
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("shared partial result sent with Cache-Control %q", cc)
+		}
+	}
+}
+
+func TestPrimaryThenVerifyNotCacheable(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"))
+	fallback := newFakeRepo(t, gem("thor", "1.0.0"))
+	configure(t, "-cache-ttl", "1h", "-primary-then-verify", "-repo", first.URL, "-repo", second.URL, "-fallback-repo", fallback.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack", "thor"), "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, []string{"rack-1.0.0", "thor-1.0.0"}) {
+		t.Errorf("primary result %v", got)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("primary result sent with Cache-Control %q", cc)
+	}
+	key := cacheKey([]string{"rack", "thor"}, defaultOptions())
+	eventually(t, func() bool {
+		_, _, ok := depCache.get(key)
+		return ok
+	})
+}
+
+func TestPrimaryThenVerifyReportsMissed(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"), gem("rack", "2.0.0"))
+	second.setLatency(50 * time.Millisecond)
+	m := configure(t, "-primary-then-verify", "-repo", first.URL, "-repo", second.URL)
+
+	start := time.Now()
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil || !equalStrings(served(deps), []string{"rack-1.0.0@" + first.URL}) {
+		t.Errorf("primary result %v, %v", served(deps), err)
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("waited %s for the other repo", d)
+	}
+
+	eventually(t, func() bool { return m.count(metricPrimaryMissed, reposFlag[1].public()) == 1 })
+}
+
+func TestHTMLErrorPageRejected(t *testing.T) {
+	repo := newFakeRepo(t)
+	repo.body = []byte("<html><body>Down for maintenance</body></html>")
+	configure(t, "-repo", repo.URL)
+
+	deps, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0])
+	if err == nil || !strings.Contains(err.Error(), "did not respond with marshal data") {
+		t.Errorf("got %v, %v", idents(deps), err)
+	}
+}
+
+func TestRedirectToLoginPage(t *testing.T) {
+	login := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Sign in</body></html>"))
+	}))
+	defer login.Close()
+	repo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, login.URL+"/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+	}))
+	defer repo.Close()
+	configure(t, "-repo", repo.URL)
+
+	_, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0])
+	if err == nil || !strings.Contains(err.Error(), "redirected its dependencies API to "+login.URL+"/login?return_to=") {
+		t.Errorf("got %v", err)
+	}
+
+	// Unless redirects are expected, say from a repo that moved.
+	moved := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-allow-deps-redirects", "-repo", redirector(t, moved.URL).URL)
+	if deps, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err != nil || len(deps) != 1 {
+		t.Errorf("with -allow-deps-redirects got %v, %v", idents(deps), err)
+	}
+}
+
+func TestWrongMarshalVersion(t *testing.T) {
+	repo := newFakeRepo(t)
+	repo.body = append([]byte{4, 9}, encodeDeps([]gemInfo{gem("rack", "1.0.0")})[2:]...)
+	configure(t, "-repo", repo.URL)
+
+	_, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0])
+	if err == nil || !strings.Contains(err.Error(), "marshal format 4.9, only 4.8 can be decoded") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTraceGem(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"), gem("rails", "7.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"), gem("rails", "7.1.0"))
+	configure(t, "-trace-gem", "rack", "-repo", first.URL, "-repo", second.URL)
+
+	out := captureOutput(t, func() {
+		if _, err := depQuery([]string{"rack", "rails"}, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var traced int
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "TRACE") {
+			continue
+		}
+		traced++
+		if !strings.HasPrefix(line, "TRACE rack: ") || strings.Contains(line, "rails") {
+			t.Errorf("traced %q", line)
+		}
+	}
+	if traced == 0 {
+		t.Errorf("nothing traced in %q", out)
+	}
+}
+
+func TestStrictMissing(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+	if w := request(handleDependencies, "GET", dependencies("rack", "missing"), ""); w.Code != http.StatusOK {
+		t.Errorf("without -strict-missing got %d", w.Code)
+	}
+
+	configure(t, "-strict-missing", "-repo", repo.URL)
+	w := request(handleDependencies, "GET", dependencies("rack", "missing", "gone"), "")
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "missing, gone") {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK {
+		t.Errorf("with every gem found got %d", w.Code)
+	}
+}
+
+func TestFallbackRepo(t *testing.T) {
+	primary := newFakeRepo(t, gem("rack", "1.0.0"))
+	fallback := newFakeRepo(t, gem("rack", "9.0.0"), gem("thor", "1.0.0"))
+	configure(t, "-repo", primary.URL, "-fallback-repo", fallback.URL)
+
+	deps, err := depQuery([]string{"rack", "thor"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(deps); !equalStrings(got, []string{"rack-1.0.0@" + primary.URL, "thor-1.0.0@" + fallback.URL}) {
+		t.Errorf("got %v", got)
+	}
+	if asked := fallback.asked(); len(asked) != 1 || !equalStrings(asked[0], []string{"thor"}) {
+		t.Errorf("fallback asked %v", asked)
+	}
+
+	// Nothing is asked of the fallback when the primaries had everything.
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if n := fallback.requestCount(); n != 1 {
+		t.Errorf("fallback asked %d times", n)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(500 * time.Millisecond)
+	configure(t, "-request-timeout", "30ms", "-repo", repo.URL)
+
+	start := time.Now()
+	w := request(handleDependencies, "GET", dependencies("rack"), "")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d", w.Code)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("answered after %s", d)
+	}
+
+	// The abandoned query gives up on the repo at the timeout too.
+	backgroundQueries.Wait()
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Errorf("abandoned query finished after %s", d)
+	}
+}
+
+func TestRepoMaxRequests(t *testing.T) {
+	limited := newFakeRepo(t, gem("rack", "1.0.0"))
+	open := newFakeRepo(t, gem("rack", "2.0.0"))
+	limited.inFlight, open.inFlight = &gauge{}, &gauge{}
+	limited.setLatency(20 * time.Millisecond)
+	open.setLatency(20 * time.Millisecond)
+	configure(t, "-repo", limited.URL+",max-requests=2", "-repo", open.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := limited.inFlight.peak(); n != 2 {
+		t.Errorf("limited repo had %d requests at once", n)
+	}
+	if n := open.inFlight.peak(); n <= 2 {
+		t.Errorf("unlimited repo had at most %d requests at once", n)
+	}
+}
+
+func TestQueryRetries(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"))
+	second.failNext(http.StatusServiceUnavailable, 1)
+	configure(t, "-require-all-repos", "-query-retries", "2", "-query-retry-backoff", "1ms", "-repo", first.URL, "-repo", second.URL)
+
+	deps, err := retryQuery([]string{"rack"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := idents(deps); !equalStrings(got, []string{"rack-1.0.0", "rack-2.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+	if n := second.requestCount(); n != 2 {
+		t.Errorf("second repo asked %d times", n)
+	}
+
+	// Without retries the blip fails the query.
+	second.failNext(http.StatusServiceUnavailable, 1)
+	configure(t, "-require-all-repos", "-repo", first.URL, "-repo", second.URL)
+	if _, err := retryQuery([]string{"rack"}, defaultOptions()); err == nil {
+		t.Error("query succeeded with a repo failing")
+	}
+}
+
+func TestSplitGemNames(t *testing.T) {
+	for _, c := range []struct {
+		normalize bool
+		query     string
+		want      []string
+		err       bool
+	}{
+		{false, "rack,Rails,", []string{"rack", "Rails"}, false},
+		{false, "rails/", nil, true},
+		{false, "rack,../etc", nil, true},
+		{true, "rack,Rails,rails/", []string{"rack", "rails", "rails"}, false},
+		{true, "RACK//", []string{"rack"}, false},
+		{true, "rack,a b", nil, true},
+	} {
+		configure(t, "-normalize-gem-names="+strconv.FormatBool(c.normalize))
+		got, err := splitGemNames(c.query)
+		if (err != nil) != c.err || !equalStrings(got, c.want) {
+			t.Errorf("-normalize-gem-names=%t %q got %v, %v", c.normalize, c.query, got, err)
+		}
+	}
+}
+
+func TestEncodedGemsTokenized(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"), gem("rails", "7.0.0"))
+	configure(t, "-repo", repo.URL)
+
+	for _, c := range []struct {
+		query string
+		want  []string
+		code  int
+	}{
+		{"rack%2Crails", []string{"rack", "rails"}, http.StatusOK},
+		{"rack%2crails,", []string{"rack", "rails"}, http.StatusOK},
+		{"rack,,rails", []string{"rack", "rails"}, http.StatusOK},
+		{"rack%252Crails", nil, http.StatusBadRequest},
+		{"rack%00", nil, http.StatusBadRequest},
+		{"%20rack", nil, http.StatusBadRequest},
+		{"rack%2F..%2Frails", nil, http.StatusBadRequest},
+	} {
+		n := len(repo.asked())
+		w := request(handleDependencies, "GET", "/api/v1/dependencies?gems="+c.query, "")
+		if w.Code != c.code {
+			t.Errorf("%s got %d %s", c.query, w.Code, w.Body)
+			continue
+		}
+		asked := repo.asked()[n:]
+		if c.want == nil {
+			if len(asked) != 0 {
+				t.Errorf("%s asked %v", c.query, asked)
+			}
+		} else if len(asked) != 1 || !equalStrings(asked[0], c.want) {
+			t.Errorf("%s asked %v", c.query, asked)
+		}
+	}
+}
+
+func TestRepoAliases(t *testing.T) {
+	primary := newFakeRepo(t, gem("rack", "1.0.0"))
+	legacy := newFakeRepo(t, gem("legacy-auth", "1.0.0"))
+	configure(t, "-repo", primary.URL, "-repo", legacy.URL+",alias=mycorp-auth:legacy-auth")
+
+	deps, err := depQuery([]string{"rack", "mycorp-auth"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(deps); !equalStrings(got, []string{"rack-1.0.0@" + primary.URL, "mycorp-auth-1.0.0@" + legacy.URL}) {
+		t.Fatalf("got %v", got)
+	}
+	if asked := legacy.asked(); len(asked) != 1 || !equalStrings(asked[0], []string{"legacy-auth", "mycorp-auth", "rack"}) {
+		t.Errorf("legacy repo asked %v", asked)
+	}
+}
+
+func TestMergeOrderAndShadowing(t *testing.T) {
+	configure(t, "-repo", "https://a.example.com/", "-repo", "https://b.example.com/")
+	a := []gemInfo{gem("rack", "2.0.0"), gem("rack", "1.0.0")}
+	b := []gemInfo{gem("thor", "1.0.0"), gem("rack", "1.0.0"), gem("rack", "3.0.0")}
+	for i := range a {
+		a[i].repo = reposFlag[0]
+	}
+	for i := range b {
+		b[i].repo = reposFlag[1]
+	}
+
+	merged := mergeDependencies([][]gemInfo{a, b}, defaultOptions())
+	want := []string{"rack-2.0.0@https://a.example.com/", "rack-1.0.0@https://a.example.com/", "thor-1.0.0@https://b.example.com/", "rack-3.0.0@https://b.example.com/"}
+	if got := served(merged); !equalStrings(got, want) {
+		t.Errorf("got %v", got)
+	}
+	if m := merged[1].mirrors; len(m) != 1 || m[0] != reposFlag[1] {
+		t.Errorf("rack-1.0.0 mirrored by %v", m)
+	}
+}
+
+// A merge the size of a large monorepo's bundle across three repos.
+func BenchmarkMergeDependencies(b *testing.B) {
+	configure(b, "-repo", "https://a.example.com/", "-repo", "https://b.example.com/", "-repo", "https://c.example.com/")
+	all := make([][]gemInfo, len(reposFlag))
+	for i, repo := range reposFlag {
+		for n := 0; n < 50000/len(reposFlag); n++ {
+			dep := gem(fmt.Sprintf("gem%d", n%5000), fmt.Sprintf("%d.%d.0", n/5000, i), "rack >= 1")
+			dep.repo = repo
+			all[i] = append(all[i], dep)
+		}
+	}
+	opts := defaultOptions()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mergeDependencies(all, opts)
+	}
+}
+
+func TestRubyVersionsPassedThrough(t *testing.T) {
+	rails := gem("rails", "7.0.0", "rack >= 1")
+	rails.RubyVersion, rails.RubygemsVersion = ">= 2.7.0", ">= 1.8.11"
+	repo := newFakeRepo(t, gem("rack", "1.0.0"), rails)
+	configure(t, "-repo", repo.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rails", "rack"), "")
+	deps := decodeDeps(t, w.Body.Bytes())
+	if len(deps) != 2 || deps[0].RubyVersion != ">= 2.7.0" || deps[0].RubygemsVersion != ">= 1.8.11" {
+		t.Fatalf("got %+v", deps)
+	}
+
+	// rack goes out without the keys at all, as RubyGems sends it.
+	type plain struct {
+		Name         string     `rmarsh:"name"`
+		Version      string     `rmarsh:"number"`
+		Platform     string     `rmarsh:"platform"`
+		Dependencies [][]string `rmarsh:"dependencies"`
+	}
+	type versioned struct {
+		Name            string     `rmarsh:"name"`
+		Version         string     `rmarsh:"number"`
+		Platform        string     `rmarsh:"platform"`
+		Dependencies    [][]string `rmarsh:"dependencies"`
+		RubyVersion     string     `rmarsh:"ruby_version"`
+		RubygemsVersion string     `rmarsh:"rubygems_version"`
+	}
+	var want bytes.Buffer
+	if err := rmarsh.NewEncoder(&want).Encode([]interface{}{
+		versioned{"rails", "7.0.0", "ruby", [][]string{{"rack", ">= 1"}}, ">= 2.7.0", ">= 1.8.11"},
+		plain{"rack", "1.0.0", "ruby", [][]string{}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+		t.Errorf("got %q, want %q", w.Body, want.Bytes())
+	}
+
+	want.Reset()
+	rmarsh.NewEncoder(&want).Encode([]plain{{"rack", "1.0.0", "ruby", [][]string{}}})
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); !bytes.Equal(w.Body.Bytes(), want.Bytes()) {
+		t.Errorf("got %q, want %q", w.Body, want.Bytes())
+	}
+}
+
+func TestWithoutDependencies(t *testing.T) {
+	repo := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"))
+	configure(t, "-repo", repo.URL)
+
+	for _, c := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"&dependencies=true", true},
+		{"&dependencies=false", false},
+	} {
+		w := request(handleDependenciesJSON, "GET", "/api/v1/dependencies.json?gems=rails"+c.query, "")
+		var out []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || len(out) != 1 {
+			t.Fatalf("%s: %s, %v", c.query, w.Body, err)
+		}
+		if _, ok := out[0]["dependencies"]; ok != c.want {
+			t.Errorf("%q: dependencies present %t", c.query, ok)
+		}
+	}
+
+	// Bundler needs the dependencies, so marshal responses only leave them
+	// out with -allow-slim-marshal.
+	full := request(handleDependencies, "GET", dependencies("rails")+"&dependencies=false", "")
+	configure(t, "-allow-slim-marshal", "-repo", repo.URL)
+	slim := request(handleDependencies, "GET", dependencies("rails")+"&dependencies=false", "")
+	if !bytes.Contains(full.Body.Bytes(), []byte("dependencies")) || bytes.Contains(slim.Body.Bytes(), []byte("dependencies")) {
+		t.Errorf("full %q, slim %q", full.Body, slim.Body)
+	}
+	if got := idents(decodeDeps(t, slim.Body.Bytes())); !equalStrings(got, []string{"rails-7.0.0"}) {
+		t.Errorf("slim response has %v", got)
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(100 * time.Millisecond)
+	configure(t, "-max-request-timeout", "5s", "-repo", repo.URL)
+
+	if w := request(handleDependencies, "GET", dependencies("rack"), "", "X-Amalgemate-Timeout", "20ms"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("with a 20ms timeout got %d", w.Code)
+	}
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK {
+		t.Errorf("without the header got %d", w.Code)
+	}
+	for _, v := range []string{"10s", "-1s", "soon"} {
+		if w := request(handleDependencies, "GET", dependencies("rack"), "", "X-Amalgemate-Timeout", v); w.Code != http.StatusBadRequest {
+			t.Errorf("X-Amalgemate-Timeout %s got %d", v, w.Code)
+		}
+	}
+}
+
+func TestTimedOutQueryReleasesUpstream(t *testing.T) {
+	hung := newFakeRepo(t, gem("rack", "1.0.0"))
+	hung.setLatency(time.Minute)
+	hung.inFlight = &gauge{}
+	fast := newFakeRepo(t, gem("rails", "7.0.0"))
+	configure(t, "-cache-ttl", "1h", "-max-upstream-requests", "1", "-request-timeout", "30ms",
+		"-repo", hung.URL+",route=rack", "-repo", fast.URL)
+
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("got %d", w.Code)
+	}
+	// The abandoned query gave its slot up, so the next one isn't stuck
+	// behind the hung repo.
+	if w := request(handleDependencies, "GET", dependencies("rails"), ""); w.Code != http.StatusOK {
+		t.Errorf("next query got %d", w.Code)
+	}
+	eventually(t, func() bool { return hung.inFlight.current() == 0 })
+	if _, _, ok := depCache.get(cacheKey([]string{"rack"}, defaultOptions())); ok {
+		t.Error("abandoned query's result cached")
+	}
+	if n := reposFlag[0].failureCount(); n != 0 {
+		t.Errorf("hung repo has %d failures for being cut off", n)
+	}
+}
+
+func TestWarnEmptyResponses(t *testing.T) {
+	full := newFakeRepo(t, gem("rack", "1.0.0"))
+	broken := newFakeRepo(t)
+	configure(t, "-warn-empty-responses", "-repo", full.URL, "-repo", broken.URL)
+
+	out := captureOutput(t, func() {
+		for _, gems := range [][]string{{"rack"}, {"missing"}} {
+			if _, err := depQuery(gems, defaultOptions()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	want := fmt.Sprintf("Warning: repo %s answered with nothing, though other repos have rack\n", reposFlag[1].public())
+	if strings.Count(out, "answered with nothing") != 1 || !strings.Contains(out, want) {
+		t.Errorf("logged %q", out)
+	}
+
+	configure(t, "-repo", full.URL, "-repo", broken.URL)
+	if out := captureOutput(t, func() { depQuery([]string{"rack"}, defaultOptions()) }); strings.Contains(out, "answered with nothing") {
+		t.Errorf("warned without -warn-empty-responses: %q", out)
+	}
+}
+
+func TestDivergentDependencies(t *testing.T) {
+	first := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 2"), gem("thor", "1.0.0"))
+	second := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"), gem("thor", "1.0.0"))
+	configure(t, "-debug", "-repo", first.URL, "-repo", second.URL)
+
+	var deps []gemInfo
+	out := captureOutput(t, func() {
+		var err error
+		if deps, err = depQuery([]string{"rails", "thor"}, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n := strings.Count(out, "has dependencies"); n != 1 || !strings.Contains(out, "rails-7.0.0 has dependencies") {
+		t.Errorf("logged %q", out)
+	}
+	for _, dep := range deps {
+		if dep.Name == "rails" && (len(dep.Dependencies) != 1 || dep.Dependencies[0][1] != ">= 2") {
+			t.Errorf("served rails' dependencies %v", dep.Dependencies)
+		}
+	}
+
+	if !sameDependencies([][]string{{"rack", ">= 1"}, {"thor", "~> 1"}}, [][]string{{"thor", "~> 1"}, {"rack", ">= 1"}}) {
+		t.Error("order counted as a difference")
+	}
+}
+
+func TestEmptyPlatformIsRuby(t *testing.T) {
+	rack := gem("rack", "1.0.0")
+	rack.Platform = ""
+	repo := newFakeRepo(t, rack)
+	configure(t, "-repo", repo.URL)
+
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0].Platform != "ruby" || deps[0].ident() != "rack-1.0.0" {
+		t.Errorf("got %v", deps)
+	}
+	if _, ok := lookupGemDir("rack-1.0.0"); !ok {
+		t.Error("rack-1.0.0 missing from gemDir")
+	}
+}
+
+func TestMaxQueryLength(t *testing.T) {
+	var gems []gemInfo
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("gem-number-%d", i)
+		gems = append(gems, gem(name, "1.0.0"))
+		names = append(names, name)
+	}
+	repo := newFakeRepo(t, gems...)
+	configure(t, "-max-query-length", "100", "-repo", repo.URL)
+
+	if w := request(handleDependencies, "GET", dependencies(names[:2]...), ""); w.Code != http.StatusOK {
+		t.Errorf("short GET got %d", w.Code)
+	}
+	if w := request(handleDependencies, "GET", dependencies(names...), ""); w.Code != http.StatusRequestURITooLong {
+		t.Errorf("long GET got %d", w.Code)
+	}
+	if n := len(repo.asked()); n != 1 {
+		t.Errorf("repo asked %d times", n)
+	}
+
+	form := "gems=" + strings.Join(names, ",")
+	w := request(handleDependencies, "POST", "/api/v1/dependencies", form, "Content-Type", "application/x-www-form-urlencoded")
+	if got := decodeDeps(t, w.Body.Bytes()); w.Code != http.StatusOK || len(got) != len(names) {
+		t.Errorf("POST got %d %v", w.Code, idents(got))
+	}
+	w = request(handleDependenciesJSON, "POST", "/api/v1/dependencies.json", form, "Content-Type", "application/x-www-form-urlencoded")
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), `"name"`) != len(names) {
+		t.Errorf("JSON POST got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPriorityShortCircuit(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"), gem("thor", "1.0.0.pre"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"), gem("rails", "7.0.0"), gem("thor", "1.0.0"))
+	third := newFakeRepo(t, gem("rails", "7.1.0"))
+	configure(t, "-merge", "priority", "-priority-short-circuit", "-exclude-prerelease",
+		"-repo", first.URL, "-repo", second.URL, "-repo", third.URL)
+
+	deps, err := depQuery([]string{"rack", "rails", "thor"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := served(deps); !equalStrings(got, []string{"rack-1.0.0@" + first.URL, "rails-7.0.0@" + second.URL, "thor-1.0.0@" + second.URL}) {
+		t.Errorf("got %v", got)
+	}
+	// Only a prerelease of thor was found first, which doesn't resolve it.
+	if asked := second.asked(); len(asked) != 1 || !equalStrings(asked[0], []string{"rails", "thor"}) {
+		t.Errorf("second repo asked %v", asked)
+	}
+	if n := third.requestCount(); n != 0 {
+		t.Errorf("third repo asked %d times", n)
+	}
+
+	// Without it, every repo is asked.
+	configure(t, "-merge", "priority", "-repo", first.URL, "-repo", second.URL, "-repo", third.URL)
+	if _, err := depQuery([]string{"rack", "rails"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if n := third.requestCount(); n != 1 {
+		t.Errorf("third repo asked %d times", n)
+	}
+}
+
+func TestRequestOrder(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"), gem("thor", "1.0.0"))
+	second := newFakeRepo(t, gem("rails", "7.0.0"), gem("rack", "2.0.0"))
+	configure(t, "-request-order", "-cache-ttl", "1h", "-repo", first.URL, "-repo", second.URL)
+
+	for _, c := range []struct {
+		gems []string
+		want []string
+	}{
+		{[]string{"thor", "rails", "rack"}, []string{"thor-1.0.0", "rails-7.0.0", "rack-1.0.0", "rack-2.0.0"}},
+		// The same gems, now cached, in another order.
+		{[]string{"rack", "thor", "rails"}, []string{"rack-1.0.0", "rack-2.0.0", "thor-1.0.0", "rails-7.0.0"}},
+	} {
+		w := request(handleDependencies, "GET", dependencies(c.gems...), "")
+		if got := idents(decodeDeps(t, w.Body.Bytes())); !equalStrings(got, c.want) {
+			t.Errorf("%v got %v", c.gems, got)
+		}
+	}
+}
+
+func TestFreshestVersionStrategy(t *testing.T) {
+	lagging := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"), gem("rack", "1.0.0"))
+	fresh := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 2"), gem("rack", "1.0.0"))
+	lagging.modified = time.Now().Add(-time.Hour)
+	fresh.modified = time.Now()
+	args := []string{"-repo", lagging.URL, "-repo", fresh.URL}
+
+	configure(t, args...)
+	deps, err := depQuery([]string{"rails"}, defaultOptions())
+	if err != nil || !equalStrings(served(deps), []string{"rails-7.0.0@" + lagging.URL}) {
+		t.Errorf("by priority got %v, %v", served(deps), err)
+	}
+
+	configure(t, append([]string{"-version-strategy", "freshest"}, args...)...)
+	deps, err = depQuery([]string{"rails"}, defaultOptions())
+	if err != nil || !equalStrings(served(deps), []string{"rails-7.0.0@" + fresh.URL}) {
+		t.Fatalf("freshest got %v, %v", served(deps), err)
+	}
+	if deps[0].Dependencies[0][1] != ">= 2" || len(deps[0].mirrors) != 1 || deps[0].mirrors[0] != reposFlag[0] {
+		t.Errorf("served dependencies %v, mirrors %v", deps[0].Dependencies, deps[0].mirrors)
+	}
+	if repos, ok := lookupGemDir("rails-7.0.0"); !ok || repos[0] != reposFlag[1] {
+		t.Error("rails-7.0.0 downloaded from the lagging repo")
+	}
+}
+
+func TestHealthiestVersionStrategy(t *testing.T) {
+	flaky := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"))
+	steady := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"))
+	args := []string{"-repo", flaky.URL, "-repo", steady.URL}
+
+	for _, c := range []struct {
+		strategy string
+		want     *fakeRepo
+	}{
+		{"priority", flaky},
+		{"healthiest", steady},
+	} {
+		configure(t, append([]string{"-version-strategy", c.strategy}, args...)...)
+		// Both are answering now, but the first has been dropping queries.
+		reposFlag[0].recordResult(errors.New("connection reset"))
+		reposFlag[0].recordResult(nil)
+		reposFlag[0].recordResult(errors.New("connection reset"))
+		deps, err := depQuery([]string{"rails"}, defaultOptions())
+		if err != nil || !equalStrings(served(deps), []string{"rails-7.0.0@" + c.want.URL}) {
+			t.Errorf("%s got %v, %v", c.strategy, served(deps), err)
+		}
+	}
+}
+
+func TestStrictEmptyMerge(t *testing.T) {
+	first, second := newFakeRepo(t), newFakeRepo(t)
+	args := []string{"-cache-ttl", "1h", "-repo", first.URL, "-repo", second.URL}
+
+	m := configure(t, args...)
+	if w := request(handleDependencies, "GET", dependencies("rack", "rails"), ""); w.Code != http.StatusOK {
+		t.Errorf("without -strict-empty-merge got %d", w.Code)
+	}
+	if n := m.count(metricEmptyMerges); n != 1 {
+		t.Errorf("counted %v empty merges", n)
+	}
+
+	m = configure(t, append([]string{"-strict-empty-merge"}, args...)...)
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK || m.count(metricEmptyMerges) != 0 {
+		t.Errorf("one missing gem got %d", w.Code)
+	}
+	if w := request(handleDependencies, "GET", dependencies("rack", "rails"), ""); w.Code != http.StatusBadGateway {
+		t.Errorf("empty merge got %d", w.Code)
+	}
+
+	// The refused result wasn't cached.
+	second.add(gem("rails", "7.0.0"))
+	w := request(handleDependencies, "GET", dependencies("rack", "rails"), "")
+	if got := idents(decodeDeps(t, w.Body.Bytes())); w.Code != http.StatusOK || !equalStrings(got, []string{"rails-7.0.0"}) {
+		t.Errorf("once a repo has one got %d %v", w.Code, got)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	for _, c := range []struct {
+		args []string
+		h    http.HandlerFunc
+		path string
+		want string
+	}{
+		{nil, handleDependencies, "/api/v1/dependencies", "application/octet-stream"},
+		{[]string{"-marshal-content-type", "application/x-marshal"}, handleDependencies, "/api/v1/dependencies", "application/x-marshal"},
+		{nil, handleDependenciesJSON, "/api/v1/dependencies.json", "application/json"},
+	} {
+		configure(t, append(c.args, "-repo", repo.URL)...)
+		w := request(c.h, "GET", c.path+"?gems=rack", "")
+		if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != c.want {
+			t.Errorf("%s %v got %d %q, want %q", c.path, c.args, w.Code, got, c.want)
+		}
+	}
+}
+
+func TestMaxDependencies(t *testing.T) {
+	var many []string
+	for i := 0; i < 5; i++ {
+		many = append(many, fmt.Sprintf("dep%d >= 0", i))
+	}
+	repo := newFakeRepo(t, gem("bloated", "1.0.0", many...), gem("rack", "1.0.0", "thor >= 1"))
+
+	for _, c := range []struct {
+		policy string
+		want   int
+	}{
+		{"warn", 5},
+		{"truncate", 3},
+	} {
+		configure(t, "-max-dependencies", "3", "-max-dependencies-policy", c.policy, "-repo", repo.URL)
+		var deps []gemInfo
+		out := captureOutput(t, func() {
+			var err error
+			if deps, err = loadDependencies(context.Background(), []string{"bloated", "rack"}, reposFlag[0]); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if want := "Warning: bloated-1.0.0 from repo " + repo.URL + " has 5 dependencies, over -max-dependencies of 3\n"; out != want {
+			t.Errorf("with %s logged %q", c.policy, out)
+		}
+		for _, dep := range deps {
+			if n := len(dep.Dependencies); dep.Name == "bloated" && n != c.want || dep.Name == "rack" && n != 1 {
+				t.Errorf("with %s %s has %d dependencies", c.policy, dep.ident(), n)
+			}
+		}
+	}
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(20 * time.Millisecond)
+	configure(t, "-coalesce-window", "100ms", "-repo", repo.URL)
+
+	query := func() {
+		if deps, err := depQuery([]string{"rack"}, defaultOptions()); err != nil || len(deps) != 1 {
+			t.Errorf("got %v, %v", idents(deps), err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query()
+		}()
+	}
+	wg.Wait()
+	// Just after the first finished, within the window.
+	query()
+	if n := repo.requestCount(); n != 1 {
+		t.Errorf("repo asked %d times within the window", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	query()
+	if n := repo.requestCount(); n != 2 {
+		t.Errorf("repo asked %d times after the window", n)
+	}
+}
+
+func TestCoalesceWindowRetriesFailures(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.failNext(http.StatusInternalServerError, 1)
+	configure(t, "-coalesce-window", "1h", "-repo", repo.URL)
+
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err == nil {
+		t.Fatal("first query succeeded")
+	}
+	if deps, err := depQuery([]string{"rack"}, defaultOptions()); err != nil || len(deps) != 1 {
+		t.Errorf("query after the failure got %v, %v", idents(deps), err)
+	}
+	if n := repo.requestCount(); n != 2 {
+		t.Errorf("repo asked %d times", n)
+	}
+}
+
+func TestCoalesceWindowKeepsTimeouts(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(100 * time.Millisecond)
+	configure(t, "-coalesce-window", "1h", "-repo", repo.URL)
+
+	impatient := defaultOptions()
+	impatient.timeout = 20 * time.Millisecond
+	done := make(chan bool)
+	go func() {
+		_, ok, _ := boundedQuery([]string{"rack"}, impatient)
+		done <- ok
+	}()
+	eventually(t, func() bool { return repo.requestCount() == 1 })
+
+	patient := defaultOptions()
+	patient.timeout = 5 * time.Second
+	deps, ok, err := boundedQuery([]string{"rack"}, patient)
+	if !ok || err != nil || len(deps) != 1 {
+		t.Errorf("patient query got %v, %t, %v", idents(deps), ok, err)
+	}
+	if <-done {
+		t.Error("impatient query didn't time out")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	configure(t, "-trusted-proxies", "10.0.0.0/8,192.168.1.1")
+
+	for _, c := range []struct {
+		peer, forwardedFor, proto string
+		ip, scheme                string
+	}{
+		{"203.0.113.9:1234", "198.51.100.1", "https", "203.0.113.9", "http"},
+		{"10.1.2.3:1234", "198.51.100.1", "https", "198.51.100.1", "https"},
+		{"10.1.2.3:1234", "198.51.100.1, 192.168.1.1", "http", "198.51.100.1", "http"},
+		// The spoofed first hop is beyond the untrusted one, so it's ignored.
+		{"10.1.2.3:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1", "http"},
+		{"10.1.2.3:1234", "", "gopher", "10.1.2.3", "http"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.peer
+		if c.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		if c.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", c.proto)
+		}
+		if ip, scheme := clientIP(r), clientScheme(r); ip != c.ip || scheme != c.scheme {
+			t.Errorf("from %s forwarded for %q: got %s over %s, want %s over %s", c.peer, c.forwardedFor, ip, scheme, c.ip, c.scheme)
+		}
+	}
+}
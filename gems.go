@@ -0,0 +1,345 @@
+package main
+
+// Handle .gem and gemspec downloads, either by redirecting the client to the
+// repo that has the gem or by proxying it.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const quickPrefix = "quick/Marshal.4.8/"
+
+func handleGem(w http.ResponseWriter, r *http.Request) {
+	gem := strings.TrimPrefix(r.URL.Path, "/gems/")
+	ident := strings.TrimSuffix(normalizePath(gem), ".gem")
+	if normalizeGemNamesFlag {
+		ident = canonicalIdent(ident)
+		gem = ident + ".gem"
+	}
+	if !versioned.MatchString(ident) || versionlessGemsFlag == "latest" && knownName(ident) {
+		handleVersionless(w, r, ident)
+		return
+	}
+	serveFromRepo(w, r, ident, "gems/"+gem)
+}
+
+// Gem file names end in -<version>, optionally followed by a platform, and
+// versions start with a digit. A name can have a hyphen and digit in it too,
+// so net-http-2.gem may be a version-less request for net-http-2, which
+// knownName tells apart.
+var versioned = regexp.MustCompile(`-[0-9]`)
+
+// Whether gemDir knows of a gem named name, other than as an ident: a
+// version-less request for a gem whose name looks versioned.
+func knownName(name string) bool {
+	if _, ok := lookupGemDir(name); ok {
+		return false
+	}
+	_, ok := latestKnownVersion(name)
+	return ok
+}
+
+// Clients asking for a gem without a version either get told so, or are sent
+// on to the newest version amalgemate knows of.
+func handleVersionless(w http.ResponseWriter, r *http.Request, name string) {
+	if versionlessGemsFlag != "latest" {
+		http.Error(w, fmt.Sprintf("No version given, ask for %s-<version>.gem", name), http.StatusNotFound)
+		return
+	}
+	version, ok := latestKnownVersion(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("No known version of %s, query its dependencies first", name), http.StatusNotFound)
+		return
+	}
+	tracef(name, "version-less download redirected to %s", version)
+	// Relative, so it holds behind a proxy that mounts amalgemate under a
+	// prefix.
+	http.Redirect(w, r, name+"-"+version+".gem", http.StatusFound)
+}
+
+// Serves gemspecs from -quick-dir if they've been seeded there, otherwise from
+// whichever repo has the gem.
+func handleQuick(w http.ResponseWriter, r *http.Request) {
+	spec := strings.TrimPrefix(r.URL.Path, "/"+quickPrefix)
+
+	if quickDirFlag != "" && spec == filepath.Base(spec) {
+		p := filepath.Join(quickDirFlag, spec)
+		if _, err := os.Stat(p); err == nil {
+			http.ServeFile(w, r, p)
+			return
+		}
+	}
+
+	ident := strings.TrimSuffix(normalizePath(spec), ".gemspec.rz")
+	if normalizeGemNamesFlag {
+		ident = canonicalIdent(ident)
+		spec = ident + ".gemspec.rz"
+	}
+	serveFromRepo(w, r, ident, quickPrefix+spec)
+}
+
+// With -normalize-gem-names a stray trailing slash is ignored.
+func normalizePath(p string) string {
+	if normalizeGemNamesFlag {
+		return strings.TrimRight(p, "/")
+	}
+	return p
+}
+
+// Sends the client the file at p from the repo that has the gem ident.
+func serveFromRepo(w http.ResponseWriter, r *http.Request, ident, p string) {
+	repos, found := lookupGemDir(ident)
+	if found {
+		traceFilef(p, "requested, gemDir has it in %s", publicRepos(repos))
+	} else {
+		traceFilef(p, "requested, not in gemDir")
+	}
+	// A file with a trusted checksum is always proxied, so it can be checked.
+	sum := trustedChecksum(p)
+	proxied := proxyDownloadsFlag || sum != ""
+
+	// Offline, or serving a snapshot, the repos can't be probed or proxied
+	// from.
+	if (offlineFlag || snapshotModeFlag == snapshotServe) && (!found || proxied) {
+		w.WriteHeader(404)
+		return
+	}
+	if maintenance.Load() && (!found || proxied) {
+		writeMaintenance(w)
+		return
+	}
+	if !found {
+		repo := probeRepos(r, p)
+		if repo == nil {
+			traceFilef(p, "no repo has it")
+			w.WriteHeader(404)
+			return
+		}
+		repos = []*repository{repo}
+		if populateGemDirFlag {
+			gemDirLock.Lock()
+			gemDir[ident] = gemDirEntry{repos: repos, added: time.Now()}
+			gemDirLock.Unlock()
+		}
+	}
+
+	if !proxied {
+		fmt.Printf("Found %s in repo %s\n", ident, repos[0].public())
+		location := repos[0].download(p)
+		status := http.StatusMovedPermanently
+		if downloadSigner != nil {
+			location = downloadSigner.sign(location)
+			// A signed link expires, so clients mustn't hold on to it.
+			status = http.StatusFound
+		}
+		traceFilef(p, "redirecting to %s from repo %s", redactURL(location), repos[0].public())
+		http.Redirect(w, r, location.String(), status)
+		return
+	}
+
+	if !acquireProxyDownload(w, r) {
+		return
+	}
+	defer releaseProxyDownload()
+
+	// Fall through the repos that have the gem in priority order, until one
+	// of them serves it.
+	for _, repo := range repos {
+		traceFilef(p, "proxying %s from repo %s", redactURL(repo.download(p)), repo.public())
+		if originHeaderFlag != "" {
+			// The public URL, so credentials in the repo URL aren't handed
+			// to clients.
+			w.Header().Set(originHeaderFlag, repo.public())
+		}
+		var err error
+		if sum != "" {
+			err = proxyVerified(w, r, repo, p, sum)
+		} else {
+			err = proxyFile(w, r, repo, p)
+		}
+		if err != nil {
+			fmt.Printf("Failed to fetch %s from repo %s: %s\n", p, repo.public(), err)
+			continue
+		}
+		return
+	}
+
+	if originHeaderFlag != "" {
+		w.Header().Del(originHeaderFlag)
+	}
+	http.Error(w, "No repository could serve "+p, http.StatusBadGateway)
+}
+
+// Limits the proxied downloads in flight, nil when unlimited. Downloads are
+// held separately from upstreamSem, so they can't starve dependency queries.
+var proxyDownloadSem chan struct{}
+
+// Waits for a download slot, or refuses the download with
+// -proxy-download-policy=reject. Returns false if the client has been
+// answered.
+func acquireProxyDownload(w http.ResponseWriter, r *http.Request) bool {
+	if proxyDownloadSem == nil {
+		return true
+	}
+	if proxyDownloadPolicyFlag == "reject" {
+		select {
+		case proxyDownloadSem <- struct{}{}:
+			return true
+		default:
+			http.Error(w, "Too many downloads in progress", http.StatusServiceUnavailable)
+			return false
+		}
+	}
+	select {
+	case proxyDownloadSem <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func releaseProxyDownload() {
+	if proxyDownloadSem != nil {
+		<-proxyDownloadSem
+	}
+}
+
+// Logs a step in resolving a download with -debug, or with -trace-gem for the
+// gem the file belongs to.
+func traceFilef(p string, format string, args ...interface{}) {
+	file := path.Base(p)
+	debugf(file+": "+format, args...)
+	for _, gem := range traceGemFlag {
+		// Versions start with a digit, which tells foo-1.0.gem apart from
+		// foo-bar-1.0.gem.
+		rest := strings.TrimPrefix(file, gem+"-")
+		if rest != file && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			tracef(gem, file+": "+format, args...)
+		}
+	}
+}
+
+func publicRepos(repos []*repository) string {
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.public())
+	}
+	return strings.Join(names, ", ")
+}
+
+// Finds a repo with the file when gemDir doesn't know of one, because the gem
+// wasn't in any dependency query this process has seen. The repos are asked
+// in priority order.
+func probeRepos(r *http.Request, p string) *repository {
+	for _, repo := range reposFlag {
+		if !reposFlag.mayProbe(repo, path.Base(p)) {
+			continue
+		}
+		req, err := http.NewRequest("HEAD", repo.download(p).String(), nil)
+		if err != nil {
+			continue
+		}
+
+		res, err := upstreamClient.Do(req.WithContext(r.Context()))
+		if err != nil {
+			fmt.Printf("Failed to probe repo %s for %s: %s\n", repo.public(), p, err)
+			continue
+		}
+		res.Body.Close()
+		traceFilef(p, "probed repo %s, %s", repo.public(), res.Status)
+
+		if res.StatusCode == http.StatusOK {
+			return repo
+		}
+	}
+	return nil
+}
+
+// Requests a file from the repo for a proxied download. A repo that hasn't
+// started answering within -proxy-attempt-timeout is given up on, so a hung
+// repo fails over like a failing one, but once it has answered the body may
+// take as long as it takes.
+func fetchDownload(r *http.Request, repo *repository, p string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", repo.download(p).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	var timer *time.Timer
+	if proxyAttemptTimeoutFlag > 0 {
+		timer = time.AfterFunc(proxyAttemptTimeoutFlag, cancel)
+	}
+	res, err := upstreamClient.Do(req.WithContext(ctx))
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			res.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("no answer within -proxy-attempt-timeout of %s", proxyAttemptTimeoutFlag)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelOnClose{res.Body, cancel}
+	return res, nil
+}
+
+// Releases a download's context along with its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Streams a file from the repo to the client. An error is only returned if
+// nothing has been written to the client yet, so another repo can be tried.
+func proxyFile(w http.ResponseWriter, r *http.Request, repo *repository, p string) error {
+	res, err := fetchDownload(r, repo, p)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	// Gems can be large, so downloads get their own write deadline rather
+	// than the server wide one.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(downloadTimeoutFlag))
+
+	// Passing the length on gives clients accurate progress. Without it the
+	// response is chunked, or for HTTP/1.0 clients ended by closing the
+	// connection.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if res.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	start := time.Now()
+	n, err := io.Copy(w, res.Body)
+	if err != nil {
+		fmt.Printf("Failed to proxy %s from repo %s after %d bytes: %s\n", p, repo.public(), n, err)
+		return nil
+	}
+	fmt.Printf("Proxied %s from repo %s, %d bytes in %s\n", p, repo.public(), n, time.Since(start))
+	return nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Two repos that both have rack-1.0.0, queried so gemDir knows it.
+func mirroredRack(t *testing.T, args ...string) (*fakeRepo, *fakeRepo) {
+	t.Helper()
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"))
+	first.serveFile("gems/rack-1.0.0.gem", []byte("from first"))
+	second.serveFile("gems/rack-1.0.0.gem", []byte("from second"))
+	configure(t, append(args, "-repo", first.URL, "-repo", second.URL)...)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	return first, second
+}
+
+func TestProxyFailover(t *testing.T) {
+	first, _ := mirroredRack(t, "-proxy-downloads")
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Body.String() != "from first" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+
+	first.fail(http.StatusServiceUnavailable)
+	w = request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusOK || w.Body.String() != "from second" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestProxyFailoverFromHungRepo(t *testing.T) {
+	first, _ := mirroredRack(t, "-proxy-downloads", "-proxy-attempt-timeout", "50ms")
+	first.setLatency(time.Minute)
+
+	start := time.Now()
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusOK || w.Body.String() != "from second" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %s", d)
+	}
+}
+
+func TestProxyAllReposFail(t *testing.T) {
+	first, second := mirroredRack(t, "-proxy-downloads", "-origin-header", "Repository-Origin")
+	first.fail(http.StatusInternalServerError)
+	second.fail(http.StatusInternalServerError)
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got %d", w.Code)
+	}
+	if v := w.Header().Get("Repository-Origin"); v != "" {
+		t.Errorf("Repository-Origin %q sent with the error", v)
+	}
+}
+
+func TestQuickDir(t *testing.T) {
+	repo := newFakeRepo(t)
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "rack-1.0.0.gemspec.rz"), []byte("seeded"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configure(t, "-quick-dir", dir, "-repo", repo.URL)
+
+	w := request(handleQuick, "GET", "/"+quickPrefix+"rack-1.0.0.gemspec.rz", "")
+	if w.Code != http.StatusOK || w.Body.String() != "seeded" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+	if n := repo.requestCount(); n != 0 {
+		t.Errorf("repo asked %d times", n)
+	}
+
+	// Anything not seeded is asked of the repos.
+	w = request(handleQuick, "GET", "/"+quickPrefix+"rails-7.0.0.gemspec.rz", "")
+	if w.Code != http.StatusNotFound || repo.requestCount() == 0 {
+		t.Errorf("got %d after %d requests", w.Code, repo.requestCount())
+	}
+}
+
+func TestDownloadBaseRedirect(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL+",download-base=https://cdn.internal/mirror/")
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusMovedPermanently {
+		t.Fatalf("got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://cdn.internal/mirror/gems/rack-1.0.0.gem" {
+		t.Errorf("redirected to %s", loc)
+	}
+}
+
+func TestNoPopulateGemDir(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"))
+	second.serveFile("gems/rack-1.0.0.gem", []byte("from second"))
+	configure(t, "-populate-gemdir=false", "-repo", first.URL, "-repo", second.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if len(gemDir) != 0 {
+		t.Errorf("gemDir has %d entries", len(gemDir))
+	}
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != second.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("got %d to %s", w.Code, loc)
+	}
+	if len(gemDir) != 0 {
+		t.Errorf("probe added %d gemDir entries", len(gemDir))
+	}
+}
+
+func TestGemDirTTL(t *testing.T) {
+	first, second := mirroredRack(t, "-gemdir-ttl", "20ms")
+	// Only the second repo has it now.
+	first.fail(http.StatusNotFound)
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if loc := w.Header().Get("Location"); loc != first.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("fresh entry redirected to %s", loc)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	w = request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if loc := w.Header().Get("Location"); loc != second.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("expired entry redirected to %s", loc)
+	}
+}
+
+func TestProxyContentLength(t *testing.T) {
+	mirroredRack(t, "-proxy-downloads")
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if cl := w.Header().Get("Content-Length"); cl != "10" {
+		t.Errorf("Content-Length %q", cl)
+	}
+
+	// An upstream that streams the file without a length.
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("from "))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("chunked"))
+	}))
+	t.Cleanup(chunked.Close)
+	configure(t, "-proxy-downloads", "-repo", chunked.URL)
+	gemDir["rack-1.0.0"] = gemDirEntry{repos: reposFlag, added: time.Now()}
+
+	w = request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Body.String() != "from chunked" || w.Header().Get("Content-Length") != "" {
+		t.Errorf("got %q with Content-Length %q", w.Body, w.Header().Get("Content-Length"))
+	}
+}
+
+func TestProxyToHTTP10Client(t *testing.T) {
+	// An upstream that streams the file without a length, too large for
+	// net/http to buffer and work the length out itself.
+	file := bytes.Repeat([]byte("gem"), 64<<10)
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(file[:1000])
+		w.(http.Flusher).Flush()
+		w.Write(file[1000:])
+	}))
+	t.Cleanup(chunked.Close)
+	configure(t, "-proxy-downloads", "-repo", chunked.URL)
+	gemDir["rack-1.0.0"] = gemDirEntry{repos: reposFlag, added: time.Now()}
+	s := httptest.NewServer(http.HandlerFunc(handleGem))
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("GET /gems/rack-1.0.0.gem HTTP/1.0\r\nHost: gems.example.com\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Read to EOF, which only comes if the server ends the body by closing
+	// the connection.
+	raw, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("%s after %q", err, raw)
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), &http.Request{Method: "GET"})
+	if err != nil {
+		t.Fatalf("%s reading %q", err, raw)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil || !bytes.Equal(body, file) {
+		t.Errorf("body of %d bytes, %v", len(body), err)
+	}
+	if res.StatusCode != http.StatusOK || res.ProtoMinor != 0 || !res.Close || len(res.TransferEncoding) != 0 || res.ContentLength != -1 {
+		t.Errorf("got %s %s, close %t, Transfer-Encoding %v, Content-Length %d", res.Proto, res.Status, res.Close, res.TransferEncoding, res.ContentLength)
+	}
+}
+
+func TestHyphenatedNames(t *testing.T) {
+	repo := newFakeRepo(t,
+		gem("net-http", "2.0.0"),
+		gem("net-http-2", "0.1.0"),
+		gem("x86-64", "1.0.0"),
+	)
+	for _, g := range []gemInfo{gem("net-http", "2.0.0"), gem("net-http-2", "0.1.0"), gem("x86-64", "1.0.0")} {
+		repo.serveFile("gems/"+g.ident()+".gem", []byte(g.Name))
+	}
+	configure(t, "-proxy-downloads", "-repo", repo.URL)
+	if _, err := depQuery([]string{"net-http", "net-http-2", "x86-64"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{
+		"net-http-2.0.0.gem":   "net-http",
+		"net-http-2-0.1.0.gem": "net-http-2",
+		"x86-64-1.0.0.gem":     "x86-64",
+	} {
+		w := request(handleGem, "GET", "/gems/"+file, "")
+		if w.Body.String() != want {
+			t.Errorf("%s got %d %q", file, w.Code, w.Body)
+		}
+	}
+	if _, ok := lookupGemDir("net-http-2"); ok {
+		t.Error("net-http-2 taken for an ident")
+	}
+}
+
+func TestLatestKnownVersionHyphenated(t *testing.T) {
+	repo := newFakeRepo(t, gem("net-http", "2.0.0"), gem("net-http-2", "0.1.0"))
+	configure(t, "-versionless-gems", "latest", "-repo", repo.URL)
+	if _, err := depQuery([]string{"net-http", "net-http-2"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"net-http": "2.0.0", "net-http-2": "0.1.0"} {
+		if got, ok := latestKnownVersion(name); !ok || got != want {
+			t.Errorf("latest %s is %s", name, got)
+		}
+	}
+	for file, want := range map[string]string{
+		"net-http.gem":   "/gems/net-http-2.0.0.gem",
+		"net-http-2.gem": "/gems/net-http-2-0.1.0.gem",
+	} {
+		if w := request(handleGem, "GET", "/gems/"+file, ""); w.Header().Get("Location") != want {
+			t.Errorf("%s got %d to %s", file, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestNormalizedDownloads(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/gems/Rack-1.0.0.gem", "/gems/rack-1.0.0.gem/"} {
+		if w := request(handleGem, "GET", p, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s got %d without -normalize-gem-names", p, w.Code)
+		}
+	}
+
+	configure(t, "-normalize-gem-names", "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/gems/Rack-1.0.0.gem", "/gems/rack-1.0.0.gem/"} {
+		w := request(handleGem, "GET", p, "")
+		if loc := w.Header().Get("Location"); loc != repo.URL+"/gems/rack-1.0.0.gem" {
+			t.Errorf("%s got %d to %s", p, w.Code, loc)
+		}
+	}
+}
+
+func TestOfflineKeepsExpiredGemDir(t *testing.T) {
+	first, _ := mirroredRack(t, "-gemdir-ttl", "10ms")
+	time.Sleep(20 * time.Millisecond)
+	n := first.requestCount()
+
+	offlineFlag = true
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if loc := w.Header().Get("Location"); loc != first.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("got %d to %s", w.Code, loc)
+	}
+	if first.requestCount() != n {
+		t.Error("repo probed offline")
+	}
+}
+
+func TestTraceDownloadResolution(t *testing.T) {
+	first := newFakeRepo(t)
+	second := newFakeRepo(t)
+	second.serveFile("gems/rack-1.0.0.gem", []byte("rack"))
+	second.serveFile("gems/rack-test-2.0.0.gem", []byte("rack-test"))
+	configure(t, "-trace-gem", "rack", "-repo", first.URL, "-repo", second.URL)
+
+	out := captureOutput(t, func() {
+		request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+		request(handleGem, "GET", "/gems/rack-test-2.0.0.gem", "")
+	})
+	var traced []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "TRACE rack: ") {
+			traced = append(traced, strings.TrimPrefix(line, "TRACE rack: "))
+		}
+	}
+	want := []string{
+		"rack-1.0.0.gem: requested, not in gemDir",
+		"rack-1.0.0.gem: probed repo " + reposFlag[0].public() + ", 404 Not Found",
+		"rack-1.0.0.gem: probed repo " + reposFlag[1].public() + ", 200 OK",
+		"rack-1.0.0.gem: redirecting to " + second.URL + "/gems/rack-1.0.0.gem from repo " + reposFlag[1].public(),
+	}
+	if !equalStrings(traced, want) {
+		t.Errorf("traced %q", traced)
+	}
+}
+
+func TestOriginHeader(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"))
+	second.serveFile("gems/rack-1.0.0.gem", []byte("from second"))
+	u, _ := url.Parse(second.URL)
+	u.User = url.UserPassword("user", "secret")
+	configure(t, "-proxy-downloads", "-origin-header", "Repository-Origin", "-repo", first.URL, "-repo", u.String())
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first repo doesn't have the file after all.
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Body.String() != "from second" {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+	if origin := w.Header().Get("Repository-Origin"); origin != second.URL {
+		t.Errorf("Repository-Origin %q", origin)
+	}
+
+	// Redirects already say where they lead.
+	configure(t, "-origin-header", "Repository-Origin", "-repo", second.URL)
+	depQuery([]string{"rack"}, defaultOptions())
+	if w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", ""); w.Header().Get("Repository-Origin") != "" {
+		t.Errorf("redirect sent Repository-Origin %q", w.Header().Get("Repository-Origin"))
+	}
+}
+
+func TestMaxProxyDownloads(t *testing.T) {
+	first, _ := mirroredRack(t, "-proxy-downloads", "-max-proxy-downloads", "2")
+	g := &gauge{}
+	first.mu.Lock()
+	first.inFlight = g
+	first.mu.Unlock()
+	first.setLatency(20 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", ""); w.Code != http.StatusOK {
+				t.Errorf("queued download got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := g.peak(); n != 2 {
+		t.Errorf("%d downloads at once, want 2", n)
+	}
+}
+
+func TestProxyDownloadPolicyReject(t *testing.T) {
+	first, _ := mirroredRack(t, "-proxy-downloads", "-max-proxy-downloads", "1", "-proxy-download-policy", "reject")
+	g := &gauge{}
+	first.mu.Lock()
+	first.inFlight = g
+	first.mu.Unlock()
+	first.setLatency(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+		close(done)
+	}()
+	eventually(t, func() bool { return g.current() == 1 })
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("download over the limit got %d", w.Code)
+	}
+	<-done
+	if w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", ""); w.Code != http.StatusOK {
+		t.Errorf("download after the slot freed got %d", w.Code)
+	}
+}
+
+func TestPlatformDownloadsFromOwningRepo(t *testing.T) {
+	linux := gem("nokogiri", "1.15.0")
+	linux.Platform = "x86_64-linux"
+	pure := newFakeRepo(t, gem("nokogiri", "1.15.0"))
+	native := newFakeRepo(t, linux)
+	configure(t, "-repo", pure.URL, "-repo", native.URL)
+
+	deps, err := depQuery([]string{"nokogiri"}, defaultOptions())
+	if err != nil || !equalStrings(served(deps), []string{"nokogiri-1.15.0@" + pure.URL, "nokogiri-1.15.0-x86_64-linux@" + native.URL}) {
+		t.Fatalf("got %v, %v", served(deps), err)
+	}
+	for file, repo := range map[string]*fakeRepo{
+		"nokogiri-1.15.0.gem":              pure,
+		"nokogiri-1.15.0-x86_64-linux.gem": native,
+	} {
+		w := request(handleGem, "GET", "/gems/"+file, "")
+		if want := repo.URL + "/gems/" + file; w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("%s got %d to %q, want %s", file, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+	if n := pure.requestCount() + native.requestCount(); n != 2 {
+		t.Errorf("repos asked %d times, probing for downloads gemDir should know", n)
+	}
+}
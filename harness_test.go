@@ -0,0 +1,472 @@
+package main
+
+// A harness of fake upstream repos, each an httptest.Server speaking the
+// dependencies API, for testing queries and handlers end to end.
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samcday/rmarsh"
+)
+
+// A fake RubyGems repo. Its settings may be changed while it's serving.
+type fakeRepo struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// The versions it has of each gem, by name.
+	gems map[string][]gemInfo
+	// Files served from /gems/ and /quick/, by path.
+	files map[string][]byte
+	// Delay before answering a request.
+	latency time.Duration
+	// When non-zero, every request is answered with this status.
+	status int
+	// When non-zero, only this many more requests get status.
+	failures int
+	// When set, served as the dependencies response in place of the gems.
+	body []byte
+	// Answers for at most this many gems a request when non-zero, like
+	// upstreams that cap their responses.
+	limit int
+	// Sent as Last-Modified with dependency responses, when not zero.
+	modified time.Time
+	// Every request it has had, dependencies and downloads.
+	requests []*http.Request
+	// Counts requests in flight, and may be shared between repos.
+	inFlight *gauge
+}
+
+// The most requests ever in flight at once.
+type gauge struct {
+	mu       sync.Mutex
+	cur, max int
+}
+
+func (g *gauge) inc() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cur++
+	if g.cur > g.max {
+		g.max = g.cur
+	}
+}
+
+func (g *gauge) dec() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cur--
+}
+
+func (g *gauge) current() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cur
+}
+
+func (g *gauge) peak() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.max
+}
+
+func newFakeRepo(t *testing.T, gems ...gemInfo) *fakeRepo {
+	t.Helper()
+	f := &fakeRepo{gems: make(map[string][]gemInfo), files: make(map[string][]byte)}
+	for _, g := range gems {
+		f.add(g)
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRepo) add(g gemInfo) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gems[g.Name] = append(f.gems[g.Name], g)
+}
+
+func (f *fakeRepo) setLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// Fails every request with status, or stops failing with zero.
+func (f *fakeRepo) fail(status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = status
+}
+
+// Fails the next n requests with status, then answers normally again.
+func (f *fakeRepo) failNext(status, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status, f.failures = status, n
+}
+
+func (f *fakeRepo) serveFile(p string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.files[p] = body
+}
+
+func (f *fakeRepo) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Clone(r.Context()))
+	latency, status, body, limit, modified, inFlight := f.latency, f.status, f.body, f.limit, f.modified, f.inFlight
+	if f.failures > 0 {
+		if f.failures--; f.failures == 0 {
+			f.status = 0
+		}
+	}
+	f.mu.Unlock()
+	if inFlight != nil {
+		inFlight.inc()
+		defer inFlight.dec()
+	}
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, "dependencies") {
+		f.mu.Lock()
+		file, ok := f.files[strings.TrimPrefix(r.URL.Path, "/")]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(file)
+		return
+	}
+
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if body != nil {
+		w.Write(body)
+		return
+	}
+
+	var out []gemInfo
+	f.mu.Lock()
+	answered := 0
+	for _, name := range strings.Split(r.URL.Query().Get("gems"), ",") {
+		versions, ok := f.gems[name]
+		if !ok {
+			continue
+		}
+		if limit > 0 && answered == limit {
+			break
+		}
+		answered++
+		out = append(out, versions...)
+	}
+	f.mu.Unlock()
+	w.Write(encodeDeps(out))
+}
+
+// The gem names asked of the dependencies API, a request at a time.
+func (f *fakeRepo) asked() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out [][]string
+	for _, r := range f.requests {
+		if !strings.HasSuffix(r.URL.Path, "dependencies") {
+			continue
+		}
+		gems := strings.Split(r.URL.Query().Get("gems"), ",")
+		sort.Strings(gems)
+		out = append(out, gems)
+	}
+	return out
+}
+
+func (f *fakeRepo) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+func (f *fakeRepo) lastRequest() *http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// The configured repo the fake is serving as.
+func (f *fakeRepo) repo() *repository {
+	for _, r := range append(append(repos(nil), reposFlag...), fallbackReposFlag...) {
+		if r.Host == f.Listener.Addr().String() {
+			return r
+		}
+	}
+	return nil
+}
+
+func gem(name, version string, deps ...string) gemInfo {
+	g := gemInfo{Name: name, Version: version, Platform: "ruby", Dependencies: [][]string{}}
+	for _, dep := range deps {
+		g.Dependencies = append(g.Dependencies, strings.SplitN(dep, " ", 2))
+	}
+	return g
+}
+
+func encodeDeps(deps []gemInfo) []byte {
+	if deps == nil {
+		deps = []gemInfo{}
+	}
+	var buf bytes.Buffer
+	if err := rmarsh.NewEncoder(&buf).Encode(deps); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeDeps(t *testing.T, body []byte) []gemInfo {
+	t.Helper()
+	var deps []gemInfo
+	if err := rmarsh.NewDecoder(bytes.NewReader(body)).Decode(&deps); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+	return deps
+}
+
+// Idents and the repo each came from, as ident@url, in merge order.
+func served(deps []gemInfo) []string {
+	var out []string
+	for _, dep := range deps {
+		out = append(out, dep.ident()+"@"+dep.repo.public())
+	}
+	return out
+}
+
+// Records metrics rather than sending them anywhere.
+type fakeMetrics struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (m *fakeMetrics) add(metric string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[strings.Join(append([]string{metric}, labels...), " ")] += delta
+}
+
+func (m *fakeMetrics) observe(metric string, value float64, labels ...string) {
+	m.add(metric, value, labels...)
+}
+
+func (m *fakeMetrics) count(metric string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counts[strings.Join(append([]string{metric}, labels...), " ")]
+}
+
+// Puts every flag back to its default, parses args as the command line, and
+// resets whatever state earlier tests or main's setup left behind. Returns
+// the metrics recorded from then on.
+func configure(t testing.TB, args ...string) *fakeMetrics {
+	t.Helper()
+	// Queries an earlier test left running still read the flags and repos.
+	backgroundQueries.Wait()
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		switch v := f.Value.(type) {
+		case *stringList:
+			*v = nil
+		case *repos:
+			*v = nil
+		case *ttlOverrides:
+			*v = nil
+		default:
+			if err := f.Value.Set(f.DefValue); err != nil {
+				t.Fatalf("resetting -%s: %s", f.Name, err)
+			}
+		}
+	})
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	gemDirLock.Lock()
+	gemDir = make(map[string]gemDirEntry)
+	gemDirLock.Unlock()
+	repoCache.Lock()
+	repoCache.entries = make(map[string]repoCacheEntry)
+	repoCache.Unlock()
+	flights.Lock()
+	flights.queries = make(map[string]*flight)
+	flights.Unlock()
+	maintenance.Store(false)
+	warnedVersions.Range(func(v, _ interface{}) bool {
+		warnedVersions.Delete(v)
+		return true
+	})
+
+	var err error
+	upstreamAllow = nil
+	if len(upstreamAllowFlag) > 0 {
+		if upstreamAllow, err = parseAllowlist(upstreamAllowFlag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trustedProxies = nil
+	if len(trustedProxiesFlag) > 0 {
+		if trustedProxies, err = parseTrustedProxies(trustedProxiesFlag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trustedChecksums = nil
+	if trustedChecksumsFlag != "" {
+		if trustedChecksums, err = loadTrustedChecksums(trustedChecksumsFlag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	downloadSigner = nil
+	if signKeyFlag != "" {
+		downloadSigner = hmacSigner{key: []byte(signKeyFlag), ttl: signTTLFlag}
+	}
+	depCache = newCache(cacheDirFlag, cacheMaxBytesFlag)
+	upstreamClient = newUpstreamClient()
+	upstreamSem = nil
+	if maxUpstreamRequestsFlag > 0 {
+		upstreamSem = make(chan struct{}, maxUpstreamRequestsFlag)
+	}
+	proxyDownloadSem = nil
+	if maxProxyDownloadsFlag > 0 {
+		proxyDownloadSem = make(chan struct{}, maxProxyDownloadsFlag)
+	}
+
+	m := &fakeMetrics{counts: make(map[string]float64)}
+	metrics = m
+	return m
+}
+
+// Makes a request of a handler, with headers given as name, value pairs.
+func request(h http.HandlerFunc, method, target string, body string, headers ...string) *httptest.ResponseRecorder {
+	var r *http.Request
+	if body != "" {
+		r = httptest.NewRequest(method, target, strings.NewReader(body))
+	} else {
+		r = httptest.NewRequest(method, target, nil)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func dependencies(gems ...string) string {
+	return "/api/v1/dependencies?gems=" + url.QueryEscape(strings.Join(gems, ","))
+}
+
+// Waits for cond, which background work will make true, failing after a
+// while.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("condition never became true")
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPriorityMergeAcrossThreeRepos(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "2.0.0"), gem("private", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"), gem("rack", "2.1.0"), gem("rails", "7.0.0", "rack >= 2.0"))
+	third := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 2.0"), gem("rails", "7.1.0"), gem("thor", "1.2.0"))
+	configure(t, "-merge", "priority", "-repo", first.URL, "-repo", second.URL, "-repo", third.URL)
+
+	w := request(handleDependencies, "GET", dependencies("rack", "rails", "thor", "private", "missing"), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+
+	// Each gem comes wholly from the first repo that has it, so the second
+	// repo's newer rack and the third repo's newer rails aren't served.
+	var got []string
+	for _, dep := range decodeDeps(t, w.Body.Bytes()) {
+		got = append(got, dep.ident())
+	}
+	want := []string{"rack-2.0.0", "private-1.0.0", "rails-7.0.0", "thor-1.2.0"}
+	if !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, c := range []struct {
+		ident string
+		repo  *fakeRepo
+	}{{"rack-2.0.0", first}, {"rails-7.0.0", second}, {"thor-1.2.0", third}} {
+		repos, ok := lookupGemDir(c.ident)
+		if !ok || repos[0].public() != c.repo.repo().public() {
+			t.Errorf("%s downloads from %v, want %s", c.ident, publicRepos(repos), c.repo.URL)
+		}
+	}
+}
+
+// Returns what f printed to stdout, where amalgemate logs.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- string(b)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	return <-out
+}
@@ -0,0 +1,130 @@
+package main
+
+// Tracks whether each repo is answering, for the /ready endpoint.
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type repoHealth struct {
+	mu          sync.Mutex
+	failures    int // Consecutive failed queries.
+	lastErr     error
+	lastFailure time.Time
+	// Whether each of the last healthWindow queries failed, oldest
+	// overwritten first.
+	recent  [healthWindow]bool
+	results int
+}
+
+// How many recent queries a repo's error rate covers.
+const healthWindow = 20
+
+func (r *repository) recordResult(err error) {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+
+	wasHealthy := r.health.failures < unhealthyAfterFlag
+	r.health.recent[r.health.results%healthWindow] = err != nil
+	r.health.results++
+	if err != nil {
+		r.health.failures++
+		r.health.lastErr = err
+		r.health.lastFailure = time.Now()
+	} else {
+		r.health.failures = 0
+	}
+
+	if !logHealthTransitionsFlag {
+		return
+	}
+	if healthy := r.health.failures < unhealthyAfterFlag; healthy != wasHealthy {
+		if healthy {
+			fmt.Printf("Repo %s has recovered\n", r.public())
+		} else {
+			fmt.Printf("Repo %s is failing, %d queries in a row: %s\n", r.public(), r.health.failures, err)
+		}
+	}
+}
+
+// Says a failing repo's answer is being left out. With
+// -log-health-transitions only the repo starting and stopping failing is
+// logged, by recordResult, so a repo that's down doesn't log every query.
+func (r *repository) logSkipped(err error) {
+	if !logHealthTransitionsFlag {
+		fmt.Printf("Skipping repo %s: %s\n", r.public(), err)
+	}
+}
+
+func (r *repository) failureCount() int {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	return r.health.failures
+}
+
+// The fraction of the repo's last healthWindow queries that failed. Unlike
+// failures in a row it isn't wiped out by one answer, so a flapping repo
+// still counts as less reliable than one that never fails.
+func (r *repository) errorRate() float64 {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+
+	n := r.health.results
+	if n == 0 {
+		return 0
+	}
+	if n > healthWindow {
+		n = healthWindow
+	}
+	failed := 0
+	for _, f := range r.health.recent[:n] {
+		if f {
+			failed++
+		}
+	}
+	return float64(failed) / float64(n)
+}
+
+// A repo is unhealthy once it has failed -unhealthy-after queries in a row,
+// until -unhealthy-for has passed without another failure. A drained replica
+// gets no queries to find out the repo is back, so it's given the benefit of
+// the doubt, and the next failure counts against it again straight away.
+func (r *repository) healthy() bool {
+	r.health.mu.Lock()
+	defer r.health.mu.Unlock()
+	if unhealthyForFlag > 0 && time.Since(r.health.lastFailure) > unhealthyForFlag {
+		return true
+	}
+	return r.health.failures < unhealthyAfterFlag
+}
+
+// Whether enough repos are unhealthy, per -ready-policy, that this replica
+// should be taken out of rotation.
+func degraded() bool {
+	unhealthy := 0
+	for _, repo := range reposFlag {
+		if !repo.healthy() {
+			unhealthy++
+		}
+	}
+
+	switch readyPolicyFlag {
+	case "any":
+		return unhealthy > 0
+	case "majority":
+		return unhealthy*2 > len(reposFlag)
+	default:
+		return unhealthy > 0 && unhealthy == len(reposFlag)
+	}
+}
+
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if degraded() {
+		http.Error(w, "Upstream repositories are failing", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyPolicy(t *testing.T) {
+	for _, c := range []struct {
+		policy  string
+		failing int
+		want    int
+	}{
+		{"any", 0, http.StatusOK},
+		{"any", 1, http.StatusServiceUnavailable},
+		{"majority", 1, http.StatusOK},
+		{"majority", 2, http.StatusServiceUnavailable},
+		{"all", 2, http.StatusOK},
+		{"all", 3, http.StatusServiceUnavailable},
+	} {
+		configure(t, "-ready-policy", c.policy, "-unhealthy-after", "2",
+			"-repo", "https://a.example.com/", "-repo", "https://b.example.com/", "-repo", "https://c.example.com/")
+		for _, repo := range reposFlag[:c.failing] {
+			repo.recordResult(errors.New("down"))
+			repo.recordResult(errors.New("down"))
+		}
+		if w := request(handleReady, "GET", "/ready", ""); w.Code != c.want {
+			t.Errorf("-ready-policy %s with %d failing got %d", c.policy, c.failing, w.Code)
+		}
+	}
+}
+
+func TestUnhealthyRecovers(t *testing.T) {
+	configure(t, "-unhealthy-after", "1", "-unhealthy-for", "20ms", "-repo", "https://a.example.com/")
+	repo := reposFlag[0]
+	repo.recordResult(errors.New("down"))
+	if w := request(handleReady, "GET", "/ready", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d with the repo failing", w.Code)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if w := request(handleReady, "GET", "/ready", ""); w.Code != http.StatusOK {
+		t.Errorf("got %d after -unhealthy-for", w.Code)
+	}
+	repo.recordResult(errors.New("still down"))
+	if repo.healthy() {
+		t.Error("healthy after failing again")
+	}
+	repo.recordResult(nil)
+	if !repo.healthy() {
+		t.Error("unhealthy after answering")
+	}
+}
+
+func TestLogHealthTransitions(t *testing.T) {
+	down := newFakeRepo(t)
+	up := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-log-health-transitions", "-unhealthy-after", "2", "-require-all-repos=false",
+		"-repo", strings.Replace(down.URL, "://", "://user:secret@", 1), "-repo", up.URL)
+
+	query := func() {
+		if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down.fail(http.StatusInternalServerError)
+	out := captureOutput(t, func() {
+		for i := 0; i < 4; i++ {
+			query()
+		}
+		down.fail(0)
+		query()
+		query()
+		down.fail(http.StatusInternalServerError)
+		query()
+	})
+	if n := strings.Count(out, "is failing"); n != 1 {
+		t.Errorf("logged failing %d times:\n%s", n, out)
+	}
+	if n := strings.Count(out, "has recovered"); n != 1 {
+		t.Errorf("logged recovering %d times:\n%s", n, out)
+	}
+	if strings.Contains(out, "Skipping repo") || strings.Contains(out, "secret") {
+		t.Errorf("logged:\n%s", out)
+	}
+}
+
+func TestErrorRate(t *testing.T) {
+	configure(t, "-repo", "https://a.example.com/")
+	repo := reposFlag[0]
+	if rate := repo.errorRate(); rate != 0 {
+		t.Errorf("%v before any queries", rate)
+	}
+	repo.recordResult(errors.New("down"))
+	repo.recordResult(nil)
+	repo.recordResult(nil)
+	repo.recordResult(errors.New("down"))
+	if rate := repo.errorRate(); rate != 0.5 {
+		t.Errorf("%v with 2 of 4 failing", rate)
+	}
+	for i := 0; i < healthWindow; i++ {
+		repo.recordResult(nil)
+	}
+	if rate := repo.errorRate(); rate != 0 {
+		t.Errorf("%v once the failures were %d queries ago", rate, healthWindow)
+	}
+}
@@ -1,105 +1,753 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
-	"github.com/samcday/rmarsh"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	reposFlag  repos
-	portFlag   int
-	listenFlag string
+	reposFlag                 repos
+	portFlag                  int
+	listenFlag                stringList
+	mergeFlag                 string
+	excludePrereleaseFlag     bool
+	requireAllReposFlag       bool
+	allowOverridesFlag        stringList
+	shortfallRetriesFlag      int
+	readTimeoutFlag           time.Duration
+	readHeaderTimeoutFlag     time.Duration
+	writeTimeoutFlag          time.Duration
+	shutdownTimeoutFlag       time.Duration
+	cacheTTLFlag              time.Duration
+	cacheTTLOverridesFlag     ttlOverrides
+	toleratePartialDecodeFlag bool
+	cacheDirFlag              string
+	cacheMaxBytesFlag         int64
+	debugFlag                 bool
+	maxRedirectsFlag          int
+	sameHostRedirectsFlag     bool
+	adminTokenFlag            string
+	proxyDownloadsFlag        bool
+	downloadTimeoutFlag       time.Duration
+	proxyAttemptTimeoutFlag   time.Duration
+	maxMergedBytesFlag        int
+	maxMergedPolicyFlag       string
+	slowUpstreamThresholdFlag time.Duration
+	h2cFlag                   bool
+	gemDirConflictFlag        string
+	versionlessGemsFlag       string
+	repoCacheTTLFlag          time.Duration
+	originHeaderFlag          string
+	quickDirFlag              string
+	maxRequestFanoutFlag      int
+	maxUpstreamRequestsFlag   int
+	snapshotDirFlag           string
+	snapshotModeFlag          string
+	authUserFlag              string
+	authPassFlag              string
+	streamThresholdFlag       int
+	repoSoftDeadlineFlag      time.Duration
+	populateGemDirFlag        bool
+	traceGemFlag              stringList
+	gemDirTTLFlag             time.Duration
+	disableKeepAliveFlag      bool
+	strictMissingFlag         bool
+	strictEmptyMergeFlag      bool
+	logHealthTransitionsFlag  bool
+	statusPageFlag            bool
+	marshalContentTypeFlag    string
+	allowDepsRedirectsFlag    bool
+	maxDependenciesFlag       int
+	maxDependenciesPolicyFlag string
+	maxProxyDownloadsFlag     int
+	proxyDownloadPolicyFlag   string
+	coalesceWindowFlag        time.Duration
+	serverTimingFlag          bool
+	upstreamAllowFlag         stringList
+	unhealthyAfterFlag        int
+	unhealthyForFlag          time.Duration
+	readyPolicyFlag           string
+	logExcludeFlag            stringList
+	logMaxFieldLenFlag        int
+	upstreamAcceptFlag        string
+	signKeyFlag               string
+	signTTLFlag               time.Duration
+	fallbackReposFlag         repos
+	requestTimeoutFlag        time.Duration
+	queryRetriesFlag          int
+	queryRetryBackoffFlag     time.Duration
+	trustedProxiesFlag        stringList
+	normalizeGemNamesFlag     bool
+	accessLogFormatFlag       string
+	tlsListenFlag             stringList
+	tlsCertFlag               string
+	tlsKeyFlag                string
+	offlineFlag               bool
+	tlsMinVersionFlag         string
+	tlsCiphersFlag            stringList
+	maintenanceRetryAfterFlag time.Duration
+	allowSlimMarshalFlag      bool
+	maxRequestTimeoutFlag     time.Duration
+	checkConfigFlag           bool
+	warnEmptyFlag             bool
+	maxConnsPerIPFlag         int
+	staleWhileRevalidateFlag  time.Duration
+	trustedChecksumsFlag      string
+	tcpKeepAliveFlag          time.Duration
+	maxQueryLengthFlag        int
+	priorityShortCircuitFlag  bool
+	requestOrderFlag          bool
+	primaryThenVerifyFlag     bool
+	versionStrategyFlag       string
 )
 
 var (
 	gemDirLock sync.RWMutex
-	gemDir     map[string]*url.URL
+	gemDir     map[string]gemDirEntry
 )
 
+// The repos known to have a gem, in priority order.
+type gemDirEntry struct {
+	name     string
+	version  string
+	platform string
+	repos    []*repository
+	added    time.Time
+}
+
+// Offline nothing could take an expired entry's place, so none expire.
+func (e gemDirEntry) expired() bool {
+	return gemDirTTLFlag > 0 && time.Since(e.added) > gemDirTTLFlag && !offlineFlag
+}
+
 func init() {
+	flag.BoolVar(&debugFlag, "debug", false, "Enable debug logging")
+	flag.Var(&traceGemFlag, "trace-gem", "Log every upstream response and merge decision involving these gems. May be given more than once.")
 	flag.IntVar(&portFlag, "port", 8080, "Specify port to listen on (8080)")
-	flag.StringVar(&listenFlag, "addr", "127.0.0.1", "Address to bind server to (127.0.0.1)")
-	flag.Var(&reposFlag, "repo", "URL of upstream RubyGems repositories. Specify one or more in order of priority.")
+	flag.StringVar(&accessLogFormatFlag, "access-log-format", "", "Log requests in Combined Log Format with combined, instead of the plain request URL")
+	flag.IntVar(&logMaxFieldLenFlag, "log-max-field-len", 0, "Truncate logged request URLs longer than this many bytes, noting how many gems they asked for. Not truncated when zero (0)")
+	flag.Var(&logExcludeFlag, "log-exclude-paths", "Request paths that aren't logged. Specify more than once to exclude several (/health,/ready,/metrics)")
+	flag.Var(&listenFlag, "addr", "Address to bind server to, as host or host:port. Specify more than once to listen on several addresses (127.0.0.1)")
+	flag.IntVar(&queryRetriesFlag, "query-retries", 0, "Times to retry a whole dependency query that failed because a repo failed under -require-all-repos (0)")
+	flag.DurationVar(&queryRetryBackoffFlag, "query-retry-backoff", time.Second, "Delay before the first -query-retries retry, doubling for each one after (1s)")
+	flag.DurationVar(&maintenanceRetryAfterFlag, "maintenance-retry-after", 5*time.Minute, "Retry-After sent with the 503s served in maintenance mode (5m)")
+	flag.BoolVar(&allowDepsRedirectsFlag, "allow-deps-redirects", false, "Accept dependencies API responses redirected to another host or path. Otherwise they're taken for a login page and the repo counts as failing.")
+	flag.StringVar(&marshalContentTypeFlag, "marshal-content-type", "application/octet-stream", "Content-Type of /api/v1/dependencies responses (application/octet-stream, as RubyGems sends)")
+	flag.BoolVar(&allowSlimMarshalFlag, "allow-slim-marshal", false, "Honour dependencies=false on /api/v1/dependencies as well as the JSON variant. Bundler can't use responses without dependencies.")
+	flag.BoolVar(&offlineFlag, "offline", false, "Never contact the upstream repositories, answering only from the cache and -snapshot-dir. For riding out upstream outages.")
+	flag.Var(&tlsListenFlag, "tls-addr", "Address to serve HTTPS on as host:port, alongside the plaintext -addr listeners. Specify more than once to listen on several addresses. Requires -tls-cert and -tls-key.")
+	flag.StringVar(&tlsCertFlag, "tls-cert", "", "Certificate file for the -tls-addr listeners")
+	flag.StringVar(&tlsMinVersionFlag, "tls-min-version", "1.2", "Oldest TLS version the -tls-addr listeners accept, either 1.2 or 1.3 (1.2)")
+	flag.Var(&tlsCiphersFlag, "tls-ciphers", "Comma separated cipher suites the -tls-addr listeners may use for TLS 1.2, by Go name (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Go's defaults when not given.")
+	flag.StringVar(&tlsKeyFlag, "tls-key", "", "Private key file for the -tls-addr listeners")
+	flag.DurationVar(&maxRequestTimeoutFlag, "max-request-timeout", 0, "Longest timeout a client may ask for with the X-Amalgemate-Timeout header, replacing -request-timeout for its request. The header is ignored when zero (0)")
+	flag.DurationVar(&requestTimeoutFlag, "request-timeout", 0, "Maximum time to spend answering a dependencies request before giving up with a 504, or 0 for no limit (0)")
+	flag.DurationVar(&tcpKeepAliveFlag, "tcp-keepalive", 0, "Interval between TCP keep-alive probes on client connections. Go's default (15s) when zero, disabled when negative (0)")
+	flag.IntVar(&maxConnsPerIPFlag, "max-conns-per-ip", 0, "Maximum connections a single client IP may have open at once, further connections are closed straight away. Unlimited when zero (0)")
+	flag.DurationVar(&readTimeoutFlag, "read-timeout", 30*time.Second, "Maximum time to read a client request, including the body (30s)")
+	flag.DurationVar(&readHeaderTimeoutFlag, "read-header-timeout", 10*time.Second, "Maximum time to read client request headers (10s)")
+	flag.DurationVar(&writeTimeoutFlag, "write-timeout", 2*time.Minute, "Maximum time to write a response to a client (2m)")
+	flag.BoolVar(&h2cFlag, "h2c", false, "Serve HTTP/2 over cleartext (h2c) as well as HTTP/1.1")
+	flag.DurationVar(&shutdownTimeoutFlag, "shutdown-timeout", 10*time.Second, "Time to let in-flight requests finish when shutting down (10s)")
+	flag.Var(&fallbackReposFlag, "fallback-repo", "URL of a repository that is only queried for gems none of the -repo repositories have. Specify more than once to try several, in order of priority. Accepts the same options as -repo.")
+	flag.BoolVar(&checkConfigFlag, "check-config", false, "Check the configuration and exit, with a non-zero status if there's a problem with it")
+	flag.Var(&reposFlag, "repo", "URL of upstream RubyGems repositories. Specify one or more in order of priority. May also be given as a comma separated list in AMALGEMATE_REPOS.")
+	flag.StringVar(&mergeFlag, "merge", mergeUnion, "Merge strategy, either union or priority (union)")
+	flag.StringVar(&versionStrategyFlag, "version-strategy", versionPriority, "Which repo serves a version several repos have, either priority, freshest by Last-Modified, or healthiest by recent error rate (priority)")
+	flag.BoolVar(&primaryThenVerifyFlag, "primary-then-verify", false, "Answer uncached queries from the highest priority repo for each gem alone, then query every repo in the background and warn about anything the answer left out")
+	flag.BoolVar(&priorityShortCircuitFlag, "priority-short-circuit", false, "With -merge=priority, ask the repos one at a time in priority order and only about the gems not already found, so fewer repos are queried at the cost of latency")
+	flag.BoolVar(&excludePrereleaseFlag, "exclude-prerelease", false, "Omit prerelease versions from dependency responses")
+	flag.BoolVar(&requireAllReposFlag, "require-all-repos", true, "Fail dependency queries if any repository fails")
+	flag.DurationVar(&repoSoftDeadlineFlag, "repo-soft-deadline", 0, "Respond without repos slower than this, letting them finish in the background to warm the cache. Disabled when zero (0)")
+	flag.IntVar(&shortfallRetriesFlag, "shortfall-retries", 0, "Follow-up requests to make when a repository answers for only some of the requested gems, for upstreams that cap their responses (0)")
+	flag.BoolVar(&serverTimingFlag, "server-timing", false, "Send Server-Timing headers on dependency responses, breaking down where the time went")
+	flag.DurationVar(&coalesceWindowFlag, "coalesce-window", 0, "Share a dependency query's result with identical queries made while it's running and for this long after, rather than asking the repos again. Disabled when zero (0)")
+	flag.DurationVar(&repoCacheTTLFlag, "repo-cache-ttl", 0, "How long each repo's own answers are cached, so a query that misses the merged cache only asks the repos whose answers have expired. Disabled when zero (0)")
+	flag.DurationVar(&cacheTTLFlag, "cache-ttl", 0, "How long dependency responses are cached, by amalgemate and by clients. Disabled when zero (0)")
+	flag.DurationVar(&staleWhileRevalidateFlag, "stale-while-revalidate", 0, "How long past its TTL a cached result may still be served, while it's refreshed in the background (0)")
+	flag.Var(&cacheTTLOverridesFlag, "cache-ttl-override", "Cache gems matching a pattern for a different time than -cache-ttl, as pattern=duration (e.g. mycorp-*=1m). May be given more than once.")
+	flag.StringVar(&cacheDirFlag, "cache-dir", "", "Directory to persist cached dependency responses in, so they survive a restart")
+	flag.Int64Var(&cacheMaxBytesFlag, "cache-max-bytes", 256<<20, "Maximum size of -cache-dir, least recently used entries are evicted first (256MiB)")
+	flag.BoolVar(&warnEmptyFlag, "warn-empty-responses", false, "Warn when a repo answers a query with nothing though other repos have some of the gems. Useful when every repo is a mirror that should have everything.")
+	flag.BoolVar(&requestOrderFlag, "request-order", false, "List gems in dependency responses in the order they were requested")
+	flag.BoolVar(&strictEmptyMergeFlag, "strict-empty-merge", false, "Respond 502 when a query for several gems finds none of them in any repository, which usually means the repositories are broken rather than the gems missing")
+	flag.BoolVar(&strictMissingFlag, "strict-missing", false, "Respond 404, naming the missing gems, when a requested gem isn't in any repository. Bundler expects them to be left out.")
+	flag.IntVar(&maxQueryLengthFlag, "max-query-length", 0, "Longest dependencies query string accepted, longer ones get a 414 asking for the gems to be POSTed. Unlimited when zero (0)")
+	flag.IntVar(&maxMergedBytesFlag, "max-merged-bytes", 0, "Maximum size of a merged dependency response. Unlimited when zero (0)")
+	flag.StringVar(&maxMergedPolicyFlag, "max-merged-policy", "error", "What to do with a response over -max-merged-bytes, either error, truncate, or stream it without buffering (error)")
+	flag.IntVar(&maxDependenciesFlag, "max-dependencies", 0, "Warn about gem versions from upstream with more dependencies than this. Unlimited when zero (0)")
+	flag.StringVar(&maxDependenciesPolicyFlag, "max-dependencies-policy", "warn", "What to do with a gem version over -max-dependencies, either warn, or truncate its dependencies to the limit (warn)")
+	flag.IntVar(&streamThresholdFlag, "stream-threshold", 32<<20, "Dependency responses estimated larger than this are streamed rather than encoded in memory first (32MiB)")
+	flag.BoolVar(&toleratePartialDecodeFlag, "tolerate-partial-decode", false, "Keep the gems decoded before a malformed repository response fails, rather than failing the repository")
+	flag.DurationVar(&slowUpstreamThresholdFlag, "slow-upstream-threshold", 0, "Log a warning for upstream requests slower than this. Disabled when zero (0)")
+	flag.IntVar(&maxRequestFanoutFlag, "max-request-fanout", 0, "Maximum repos a single request queries at once. Unlimited when zero (0)")
+	flag.IntVar(&maxUpstreamRequestsFlag, "max-upstream-requests", 0, "Maximum upstream requests in flight across all clients. Unlimited when zero (0)")
+	flag.StringVar(&snapshotDirFlag, "snapshot-dir", "", "Directory holding a snapshot of upstream dependency data")
+	flag.StringVar(&snapshotModeFlag, "snapshot-mode", "", "Either capture upstream responses into -snapshot-dir, or serve from it without contacting upstreams")
+	flag.BoolVar(&disableKeepAliveFlag, "disable-keepalive", false, "Use a fresh connection for every upstream request")
+	flag.Var(&upstreamAllowFlag, "upstream-allow", "Comma separated host names, patterns (*.example.com), IPs or CIDRs that upstream requests may be made to. Upstream requests ignore HTTP(S)_PROXY when given. Unrestricted when not given.")
+	flag.BoolVar(&normalizeGemNamesFlag, "normalize-gem-names", false, "Lowercase requested gem names and ignore trailing slashes, for clients that don't preserve gem names exactly. RubyGems names are case sensitive, so gems with uppercase names can't be queried with this on.")
+	flag.Var(&trustedProxiesFlag, "trusted-proxies", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For and X-Forwarded-Proto headers are believed")
+	flag.IntVar(&unhealthyAfterFlag, "unhealthy-after", 3, "Consecutive failed queries after which a repository is considered unhealthy (3)")
+	flag.DurationVar(&unhealthyForFlag, "unhealthy-for", 30*time.Second, "How long after its last failure an unhealthy repository stops counting against /ready, so a replica taken out of rotation comes back to try it again. Forever when zero (30s)")
+	flag.BoolVar(&statusPageFlag, "status-page", false, "Serve an HTML status page for operators at /status, behind -admin-token")
+	flag.BoolVar(&logHealthTransitionsFlag, "log-health-transitions", false, "Log only when a repository starts failing, after -unhealthy-after failures in a row, and when it recovers, rather than every failed query")
+	flag.StringVar(&readyPolicyFlag, "ready-policy", "all", "How many repositories must be unhealthy for /ready to fail, either any, majority or all (all)")
+	flag.IntVar(&maxRedirectsFlag, "max-redirects", 10, "Maximum redirects to follow from an upstream repository (10)")
+	flag.BoolVar(&sameHostRedirectsFlag, "same-host-redirects", false, "Only follow upstream redirects to the repository's own host")
+	flag.BoolVar(&populateGemDirFlag, "populate-gemdir", true, "Remember which repo each queried gem came from. When disabled, downloads probe the repos instead, trading latency for memory.")
+	flag.DurationVar(&gemDirTTLFlag, "gemdir-ttl", 0, "Forget which repo a gem came from after this long, so it's resolved afresh. Never forgotten when zero (0)")
+	flag.StringVar(&gemDirConflictFlag, "gemdir-conflict", "last", "Which repo to download a gem from when queries disagree on where it comes from, either first or last seen (last)")
+	flag.StringVar(&versionlessGemsFlag, "versionless-gems", "error", "What to do with /gems/ downloads that name no version, like /gems/rails.gem, either error or latest to redirect to the newest version queries have seen (error)")
+	flag.StringVar(&quickDirFlag, "quick-dir", "", "Directory of .gemspec.rz files to serve from /quick/Marshal.4.8/ before asking the repos")
+	flag.StringVar(&trustedChecksumsFlag, "trusted-checksums", "", "File of trusted SHA-256 checksums, as written by sha256sum. Listed files are always proxied, and refused if a repo serves them with a different checksum.")
+	flag.IntVar(&maxProxyDownloadsFlag, "max-proxy-downloads", 0, "Maximum proxied downloads in flight at once. Unlimited when zero (0)")
+	flag.StringVar(&proxyDownloadPolicyFlag, "proxy-download-policy", "queue", "What to do with a proxied download over -max-proxy-downloads, either queue it or reject it with a 503 (queue)")
+	flag.BoolVar(&proxyDownloadsFlag, "proxy-downloads", false, "Serve .gem downloads through amalgemate, failing over between repos, rather than redirecting to the repo")
+	flag.StringVar(&upstreamAcceptFlag, "upstream-accept", "*/*", "Accept header sent with dependency requests to repos without an accept option (*/*)")
+	flag.StringVar(&signKeyFlag, "sign-key", "", "Key to sign download redirects with, adding expires= and signature= (HMAC-SHA256 of the path and expiry) for CDNs that only serve signed links")
+	flag.DurationVar(&signTTLFlag, "sign-ttl", 5*time.Minute, "How long signed download redirects stay valid (5m)")
+	flag.StringVar(&originHeaderFlag, "origin-header", "", "Response header naming the repo a proxied download came from (e.g. Repository-Origin). Not sent when empty.")
+	flag.DurationVar(&downloadTimeoutFlag, "download-timeout", 10*time.Minute, "Maximum time to write a proxied .gem download to a client (10m)")
+	flag.DurationVar(&proxyAttemptTimeoutFlag, "proxy-attempt-timeout", 30*time.Second, "Maximum time to wait for a repo to start sending a proxied download before failing over to the next repo that has it. Unbounded when zero (30s)")
+	flag.StringVar(&authUserFlag, "auth-user", "", "Require clients to authenticate with HTTP Basic auth as this user")
+	flag.StringVar(&authPassFlag, "auth-pass", "", "Password for -auth-user")
+	flag.StringVar(&adminTokenFlag, "admin-token", "", "Bearer token required by the admin and debug endpoints, which are disabled without it")
+	flag.Var(&allowOverridesFlag, "allow-overrides", "Comma separated settings clients may override per request via headers (merge, prerelease, require-all-repos)")
 
-	gemDir = make(map[string]*url.URL)
+	gemDir = make(map[string]gemDirEntry)
+}
+
+func debugf(format string, args ...interface{}) {
+	if debugFlag {
+		fmt.Printf("DEBUG: "+format+"\n", args...)
+	}
+}
+
+// Logs verbosely about the gems named by -trace-gem, and nothing else.
+func tracef(gem string, format string, args ...interface{}) {
+	if traceGemFlag.has(gem) {
+		fmt.Printf("TRACE %s: "+format+"\n", append([]interface{}{gem}, args...)...)
+	}
 }
 
 func updateGemDir(deps []gemInfo) {
+	if !populateGemDirFlag {
+		return
+	}
+
 	gemDirLock.Lock()
 	defer gemDirLock.Unlock()
 
 	for _, dep := range deps {
-		gemDir[dep.ident()] = dep.repo
+		if existing, ok := gemDir[dep.ident()]; ok && !existing.expired() && existing.repos[0] != dep.repo {
+			fmt.Printf("Conflict for %s: previously from repo %s, now from repo %s\n", dep.ident(), existing.repos[0].public(), dep.repo.public())
+			if gemDirConflictFlag == "first" {
+				continue
+			}
+		}
+		gemDir[dep.ident()] = gemDirEntry{
+			name:     dep.Name,
+			version:  dep.Version,
+			platform: dep.Platform,
+			repos:    append([]*repository{dep.repo}, dep.mirrors...),
+			added:    time.Now(),
+		}
+	}
+}
+
+// Forgets where the named gems come from, or every gem when none are named.
+// Entries found by probing don't know their gem's name, so it's inferred
+// from the ident, which has the version, and so a digit, after the name:
+// purging rack mustn't purge rack-test. Returns how many entries were dropped.
+func purgeGemDir(names []string) int {
+	gemDirLock.Lock()
+	defer gemDirLock.Unlock()
+
+	purged := 0
+	for ident, entry := range gemDir {
+		matched := len(names) == 0
+		for _, name := range names {
+			if entry.name == name {
+				matched = true
+				break
+			}
+			rest := strings.TrimPrefix(ident, name+"-")
+			if entry.name == "" && rest != ident && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			delete(gemDir, ident)
+			purged++
+		}
 	}
+	return purged
+}
+
+// Returns the repos that have the gem, unless it's unknown or the entry has
+// outlived -gemdir-ttl.
+func lookupGemDir(ident string) ([]*repository, bool) {
+	gemDirLock.RLock()
+	defer gemDirLock.RUnlock()
+
+	entry, ok := gemDir[ident]
+	if !ok || entry.expired() {
+		return nil, false
+	}
+	return entry.repos, true
+}
+
+// Finds the newest version of the named gem that gemDir knows of, preferring
+// releases to prereleases as RubyGems does. Only the ruby platform is
+// considered, since there's no telling which platform the client wanted.
+func latestKnownVersion(name string) (string, bool) {
+	gemDirLock.RLock()
+	defer gemDirLock.RUnlock()
+
+	var latest gemInfo
+	for _, entry := range gemDir {
+		if entry.name != name || entry.platform != "ruby" || entry.expired() {
+			continue
+		}
+		candidate := gemInfo{Name: name, Version: entry.version}
+		switch {
+		case latest.Version == "":
+		case candidate.prerelease() != latest.prerelease():
+			if candidate.prerelease() {
+				continue
+			}
+		case compareVersions(candidate.Version, latest.Version) <= 0:
+			continue
+		}
+		latest = candidate
+	}
+	return latest.Version, latest.Version != ""
+}
+
+// Finds the gemDir ident matching ident regardless of case, for clients that
+// don't preserve the case of gem names. Idents carry versions, which can't be
+// lowercased safely, so the known idents are searched instead.
+func canonicalIdent(ident string) string {
+	gemDirLock.RLock()
+	defer gemDirLock.RUnlock()
+
+	if _, ok := gemDir[ident]; ok {
+		return ident
+	}
+	for known := range gemDir {
+		if strings.EqualFold(known, ident) {
+			return known
+		}
+	}
+	return ident
 }
 
 func main() {
 	flag.Parse()
 
+	if err := reposFromEnv(); err != nil {
+		fmt.Println("Invalid AMALGEMATE_REPOS:", err)
+		os.Exit(1)
+	}
+
 	if len(reposFlag) == 0 {
 		fmt.Println("Need at least one repository specified!")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	http.HandleFunc("/api/v1/dependencies", func(w http.ResponseWriter, r *http.Request) {
-		gems := r.URL.Query().Get("gems")
-		if gems == "" {
-			return
+	if !validMerge(mergeFlag) {
+		fmt.Printf("Unknown merge strategy %q!\n", mergeFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if !validVersionStrategy(versionStrategyFlag) {
+		fmt.Printf("Unknown -version-strategy %q!\n", versionStrategyFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(tlsListenFlag) > 0 {
+		// Checked now, rather than by the first TLS handshake.
+		if _, err := tls.LoadX509KeyPair(tlsCertFlag, tlsKeyFlag); err != nil {
+			fmt.Println("Invalid -tls-cert or -tls-key:", err)
+			flag.Usage()
+			os.Exit(1)
 		}
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		fmt.Println("Invalid TLS settings:", err)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		result, err := depQuery(strings.Split(gems, ","))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if accessLogFormatFlag != "" && accessLogFormatFlag != "combined" {
+		fmt.Printf("Unknown -access-log-format %q!\n", accessLogFormatFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if readyPolicyFlag != "any" && readyPolicyFlag != "majority" && readyPolicyFlag != "all" {
+		fmt.Printf("Unknown -ready-policy %q!\n", readyPolicyFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if gemDirConflictFlag != "first" && gemDirConflictFlag != "last" {
+		fmt.Printf("Unknown -gemdir-conflict %q!\n", gemDirConflictFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if strings.ContainsAny(originHeaderFlag, " \t\r\n:") {
+		fmt.Printf("Invalid -origin-header %q!\n", originHeaderFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if signKeyFlag != "" {
+		if signTTLFlag <= 0 {
+			fmt.Println("-sign-ttl must be positive!")
+			flag.Usage()
+			os.Exit(1)
 		}
+		downloadSigner = hmacSigner{key: []byte(signKeyFlag), ttl: signTTLFlag}
+	}
 
-		rmarsh.NewEncoder(w).Encode(result)
-	})
+	if versionlessGemsFlag != "error" && versionlessGemsFlag != "latest" {
+		fmt.Printf("Unknown -versionless-gems %q!\n", versionlessGemsFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-	http.HandleFunc("/gems/", func(w http.ResponseWriter, r *http.Request) {
-		gem := strings.TrimPrefix(r.URL.Path, "/gems/")
+	if snapshotModeFlag != "" && (snapshotDirFlag == "" || snapshotModeFlag != snapshotCapture && snapshotModeFlag != snapshotServe) {
+		fmt.Println("-snapshot-mode must be capture or serve, and needs -snapshot-dir!")
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		gemDirLock.RLock()
-		repo, found := gemDir[strings.TrimSuffix(gem, ".gem")]
-		gemDirLock.RUnlock()
+	if maxMergedPolicyFlag != "error" && maxMergedPolicyFlag != "truncate" && maxMergedPolicyFlag != "stream" {
+		fmt.Printf("Unknown -max-merged-policy %q!\n", maxMergedPolicyFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
 
-		if !found {
-			w.WriteHeader(404)
-			return
+	if proxyDownloadPolicyFlag != "queue" && proxyDownloadPolicyFlag != "reject" {
+		fmt.Printf("Unknown -proxy-download-policy %q!\n", proxyDownloadPolicyFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if maxDependenciesPolicyFlag != "warn" && maxDependenciesPolicyFlag != "truncate" {
+		fmt.Printf("Unknown -max-dependencies-policy %q!\n", maxDependenciesPolicyFlag)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(upstreamAllowFlag) > 0 {
+		var err error
+		if upstreamAllow, err = parseAllowlist(upstreamAllowFlag); err != nil {
+			fmt.Println("Invalid -upstream-allow:", err)
+			os.Exit(1)
+		}
+	}
+	if len(trustedProxiesFlag) > 0 {
+		var err error
+		if trustedProxies, err = parseTrustedProxies(trustedProxiesFlag); err != nil {
+			fmt.Println("Invalid -trusted-proxies:", err)
+			os.Exit(1)
+		}
+	}
+
+	if trustedChecksumsFlag != "" {
+		var err error
+		if trustedChecksums, err = loadTrustedChecksums(trustedChecksumsFlag); err != nil {
+			fmt.Println("Invalid -trusted-checksums:", err)
+			os.Exit(1)
 		}
+	}
+
+	if checkConfigFlag {
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+
+	if cacheDirFlag != "" {
+		if err := os.MkdirAll(cacheDirFlag, 0755); err != nil {
+			fmt.Println("Unable to create cache directory:", err)
+			os.Exit(1)
+		}
+	}
+	depCache = newCache(cacheDirFlag, cacheMaxBytesFlag)
+	upstreamClient = newUpstreamClient()
+	if maxUpstreamRequestsFlag > 0 {
+		upstreamSem = make(chan struct{}, maxUpstreamRequestsFlag)
+	}
+	if maxProxyDownloadsFlag > 0 {
+		proxyDownloadSem = make(chan struct{}, maxProxyDownloadsFlag)
+	}
+
+	if flag.Arg(0) == "query" {
+		runQuery(flag.Args()[1:])
+	}
+
+	routes(http.DefaultServeMux)
 
-		fmt.Printf("Found %s in repo %s\n", gem, repo)
-		http.Redirect(w, r, fmt.Sprintf("%sgems/%s", repo, gem), http.StatusMovedPermanently)
+	server := newServer()
+	server.TLSConfig = tlsConfig
+	if err := serve(server, listenAddrs(), tlsListenFlag); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+// Registers every endpoint on mux. Anything else is left to mux's 404,
+// including the compact index's /versions and /info/ and Bundler's /api/v2/
+// probes, which is what sends Bundler to the dependency API instead.
+func routes(mux *http.ServeMux) {
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
 	})
+	mux.HandleFunc("/ready", handleReady)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/config", adminOnly(handleDebugConfig))
+	mux.HandleFunc("/debug/requests", adminOnly(handleDebugRequests))
+	if statusPageFlag {
+		mux.HandleFunc("/status", adminOnly(handleStatus))
+	}
+	mux.HandleFunc("/admin/prefetch", adminOnly(handlePrefetch))
+	mux.HandleFunc("/admin/purge", adminOnly(handlePurge))
+	mux.HandleFunc("/admin/maintenance", adminOnly(handleMaintenance))
+	mux.HandleFunc("/api/v1/dependencies", measured("dependencies", handleDependencies))
+	mux.HandleFunc("/api/v1/dependencies.json", measured("dependencies.json", handleDependenciesJSON))
 
-	addr := fmt.Sprintf("%s:%d", listenFlag, portFlag)
-	fmt.Println("Listening on", addr)
-	http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println(r.URL)
-		http.DefaultServeMux.ServeHTTP(w, r)
-	}))
+	mux.HandleFunc("/resolve", handleResolve)
+	mux.HandleFunc("/gems/", handleGem)
+	mux.HandleFunc("/"+quickPrefix, handleQuick)
 }
 
-type repos []*url.URL
+// Repos given as flags take precedence over the environment.
+func reposFromEnv() error {
+	v := os.Getenv("AMALGEMATE_REPOS")
+	if v == "" || len(reposFlag) > 0 {
+		return nil
+	}
+	var err error
+	reposFlag, err = parseRepoList(v)
+	return err
+}
+
+// Addresses given without a port listen on -port.
+func listenAddrs() []string {
+	addrs := listenFlag
+	if len(addrs) == 0 {
+		addrs = stringList{"127.0.0.1"}
+	}
 
-func (s *repos) String() string {
-	return fmt.Sprint(*s)
+	var out []string
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(portFlag))
+		}
+		out = append(out, addr)
+	}
+	return out
 }
 
-func (s *repos) Set(v string) error {
-	u, err := url.Parse(v)
-	if err != nil {
-		return err
+// Keep-alives let dead peers, often left behind by load balancers, be noticed
+// and their connections freed.
+func listenConfig() net.ListenConfig {
+	return net.ListenConfig{KeepAlive: tcpKeepAliveFlag}
+}
+
+// Serves on every address until one of the listeners fails or the process is
+// asked to stop, at which point the server is shut down gracefully, closing
+// all the listeners.
+func serve(server *http.Server, addrs, tlsAddrs []string) error {
+	lc := listenConfig()
+	var listeners []net.Listener
+	for _, addr := range append(append([]string(nil), addrs...), tlsAddrs...) {
+		l, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		if maxConnsPerIPFlag > 0 {
+			l = newLimitListener(l, maxConnsPerIPFlag)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, l := range listeners {
+		if i >= len(addrs) {
+			fmt.Println("Listening with TLS on", l.Addr())
+			go func(l net.Listener) {
+				errs <- server.ServeTLS(l, tlsCertFlag, tlsKeyFlag)
+			}(l)
+			continue
+		}
+		fmt.Println("Listening on", l.Addr())
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	var err error
+	select {
+	case err = <-errs:
+	case s := <-sig:
+		fmt.Println("Received", s, "shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutFlag)
+	defer cancel()
+	if serr := server.Shutdown(ctx); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// Only TLS 1.2 and up are allowed, and none of the cipher suites Go considers
+// insecure.
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	switch tlsMinVersionFlag {
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported -tls-min-version %q", tlsMinVersionFlag)
+	}
+
+	secure := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		secure[c.Name] = c.ID
+	}
+	for _, name := range tlsCiphersFlag {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure -tls-ciphers suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
 	}
+	return config, nil
+}
 
-	*s = append(*s, u)
+// The timeouts stop slow clients from tying up connections indefinitely.
+func newServer() *http.Server {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLogFormatFlag == "" && !logExcluded(r.URL.Path) {
+			fmt.Println(clientIP(r), clientScheme(r), truncateLogged(r.URL.String()))
+		}
+		if looped(r) {
+			fmt.Println("Refusing request that came from this server, an upstream leads back here:", r.URL)
+			http.Error(w, "Request loops back to amalgemate", http.StatusLoopDetected)
+			return
+		}
+		requireAuth(http.DefaultServeMux).ServeHTTP(w, r)
+	})
+	if accessLogFormatFlag == "combined" {
+		handler = combinedLog(handler)
+	}
+	if adminTokenFlag != "" {
+		handler = traceRequests(handler)
+	}
+
+	// Lets a plaintext listener speak HTTP/2 to clients that ask for it.
+	if h2cFlag {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	return &http.Server{
+		ReadTimeout:       readTimeoutFlag,
+		ReadHeaderTimeout: readHeaderTimeoutFlag,
+		WriteTimeout:      writeTimeoutFlag,
+		Handler:           handler,
+	}
+}
+
+// Health checks and metrics scrapes would otherwise drown out everything else
+// in the request log.
+func logExcluded(p string) bool {
+	excluded := logExcludeFlag
+	if len(excluded) == 0 {
+		excluded = stringList{"/health", "/ready", "/metrics"}
+	}
+	return excluded.has(p)
+}
+
+// Dependency queries can name hundreds of gems, which makes for enormous log
+// lines. Past -log-max-field-len the URL is cut at a gem boundary, saying how
+// many gems there were in all.
+func truncateLogged(s string) string {
+	if logMaxFieldLenFlag <= 0 || len(s) <= logMaxFieldLenFlag {
+		return s
+	}
+
+	// Clients may send the commas escaped.
+	cut := s[:logMaxFieldLenFlag]
+	if i := strings.LastIndex(cut, ","); i > 0 {
+		cut = cut[:i+1]
+	} else if i := strings.LastIndex(strings.ToUpper(cut), "%2C"); i > 0 {
+		cut = cut[:i+3]
+	}
+	if u, err := url.Parse(s); err == nil {
+		if gems := u.Query().Get("gems"); gems != "" {
+			return fmt.Sprintf("%s... (%d gems)", cut, len(strings.Split(gems, ",")))
+		}
+	}
+	return fmt.Sprintf("%s... (%d bytes)", cut, len(s))
+}
+
+// A comma separated list flag, which may also be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*s = append(*s, item)
+		}
+	}
 	return nil
 }
+
+func (s stringList) has(v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestServerTimeouts(t *testing.T) {
+	configure(t, "-read-timeout", "3s", "-read-header-timeout", "1s", "-write-timeout", "7s")
+
+	server := newServer()
+	if server.ReadTimeout != 3*time.Second || server.ReadHeaderTimeout != time.Second || server.WriteTimeout != 7*time.Second {
+		t.Errorf("got read %s, read header %s, write %s", server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	configure(t)
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	})}
+
+	done := make(chan error, 1)
+	go func() { done <- serve(server, addrs, nil) }()
+
+	for _, addr := range addrs {
+		addr := addr
+		eventually(t, func() bool {
+			res, err := http.Get("http://" + addr + "/")
+			if err != nil {
+				return false
+			}
+			res.Body.Close()
+			return res.StatusCode == http.StatusOK
+		})
+	}
+
+	// Closing the server closes every listener.
+	server.Close()
+	if err := <-done; err != http.ErrServerClosed {
+		t.Errorf("serve returned %v", err)
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still listening", addr)
+		}
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	configure(t, "-port", "9000", "-addr", "127.0.0.1", "-addr", "[::1]", "-addr", "0.0.0.0:8081")
+
+	got := listenAddrs()
+	want := []string{"127.0.0.1:9000", "[::1]:9000", "0.0.0.0:8081"}
+	if !equalStrings(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReposFromEnv(t *testing.T) {
+	t.Setenv("AMALGEMATE_REPOS", "https://a.example.com/,pin=mycorp-*, https://b.example.com/")
+	configure(t)
+	if err := reposFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reposFlag) != 2 || reposFlag[0].public() != "https://a.example.com/" || reposFlag[1].public() != "https://b.example.com/" {
+		t.Fatalf("got %v", reposFlag)
+	}
+	if len(reposFlag[0].pins) != 1 {
+		t.Errorf("options not applied: %v", reposFlag[0].pins)
+	}
+
+	t.Setenv("AMALGEMATE_REPOS", "https://a.example.com/,download-base=https://cdn.example.com/a/,https://b.example.com/")
+	configure(t)
+	if err := reposFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reposFlag) != 2 || reposFlag[1].public() != "https://b.example.com/" {
+		t.Fatalf("got %v", debugRepos(reposFlag))
+	}
+	if got := reposFlag[0].download("gems/rack-1.0.0.gem").String(); got != "https://cdn.example.com/a/gems/rack-1.0.0.gem" {
+		t.Errorf("downloads from %s", got)
+	}
+
+	// Flags win.
+	configure(t, "-repo", "https://c.example.com/")
+	if err := reposFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reposFlag) != 1 || reposFlag[0].public() != "https://c.example.com/" {
+		t.Errorf("got %v", reposFlag)
+	}
+
+	t.Setenv("AMALGEMATE_REPOS", "https://a.example.com/,bogus=1")
+	configure(t)
+	if err := reposFromEnv(); err == nil {
+		t.Error("invalid repo option accepted")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-h2c", "-repo", repo.URL)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/dependencies", handleDependencies)
+	defaultMux := http.DefaultServeMux
+	http.DefaultServeMux = mux
+	defer func() { http.DefaultServeMux = defaultMux }()
+
+	s := httptest.NewServer(newServer().Handler)
+	defer s.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	res, err := client.Get(s.URL + dependencies("rack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.ProtoMajor != 2 || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %s %s", res.Proto, res.Status)
+	}
+	if got := idents(decodeDeps(t, body)); !equalStrings(got, []string{"rack-1.0.0"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestGemDirConflict(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		want   int
+	}{{"last", 1}, {"first", 0}} {
+		configure(t, "-repo", "https://a.example.com/", "-repo", "https://b.example.com/", "-gemdir-conflict", c.policy)
+		a, b := gem("rack", "1.0.0"), gem("rack", "1.0.0")
+		a.repo, b.repo = reposFlag[0], reposFlag[1]
+
+		updateGemDir([]gemInfo{a})
+		out := captureOutput(t, func() { updateGemDir([]gemInfo{b}) })
+		if !strings.Contains(out, "Conflict for rack-1.0.0: previously from repo https://a.example.com/, now from repo https://b.example.com/") {
+			t.Errorf("%s: logged %q", c.policy, out)
+		}
+		if repos, _ := lookupGemDir("rack-1.0.0"); repos[0] != reposFlag[c.want] {
+			t.Errorf("%s: downloads from %s", c.policy, repos[0].public())
+		}
+	}
+}
+
+func TestLogExcludePaths(t *testing.T) {
+	for _, c := range []struct {
+		args   []string
+		path   string
+		logged bool
+	}{
+		{nil, "/health", false},
+		{nil, "/metrics", false},
+		{nil, "/api/v1/dependencies", true},
+		{[]string{"-log-exclude-paths", "/api/v1/dependencies"}, "/api/v1/dependencies", false},
+		{[]string{"-log-exclude-paths", "/api/v1/dependencies"}, "/health", true},
+	} {
+		configure(t, c.args...)
+		h := newServer().Handler
+		out := captureOutput(t, func() {
+			request(h.ServeHTTP, "GET", c.path, "")
+		})
+		if logged := strings.Contains(out, c.path); logged != c.logged {
+			t.Errorf("%v %s logged %q", c.args, c.path, out)
+		}
+	}
+}
+
+func TestLogMaxFieldLen(t *testing.T) {
+	var gems []gemInfo
+	var names []string
+	for i := 0; i < 50; i++ {
+		gems = append(gems, gem(fmt.Sprintf("gem%d", i), "1.0.0"))
+		names = append(names, fmt.Sprintf("gem%d", i))
+	}
+	repo := newFakeRepo(t, gems...)
+	configure(t, "-log-max-field-len", "40", "-repo", repo.URL)
+	target := dependencies(names...)
+
+	out := captureOutput(t, func() {
+		request(newServer().Handler.ServeHTTP, "GET", target, "")
+	})
+	if want := "/api/v1/dependencies?gems=gem0%2Cgem1%2C... (50 gems)\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("logged %q", out)
+	}
+	if w := request(handleDependencies, "GET", target, ""); len(decodeDeps(t, w.Body.Bytes())) != len(names) {
+		t.Errorf("served %d gems", len(decodeDeps(t, w.Body.Bytes())))
+	}
+
+	for _, c := range []struct{ in, want string }{
+		{"/api/v1/dependencies?gems=rack", "/api/v1/dependencies?gems=rack"},
+		{"/api/v1/dependencies?gems=gem0,gem1,gem2,gem3", "/api/v1/dependencies?gems=gem0,gem1,... (4 gems)"},
+		{"/api/v1/dependencies?gems=gem0%2cgem1%2cgem2", "/api/v1/dependencies?gems=gem0%2cgem1%2c... (3 gems)"},
+		{"/gems/" + strings.Repeat("x", 50) + ".gem", "/gems/" + strings.Repeat("x", 34) + "... (60 bytes)"},
+	} {
+		if got := truncateLogged(c.in); got != c.want {
+			t.Errorf("truncateLogged(%q) = %q", c.in, got)
+		}
+	}
+}
+
+// Writes a self-signed certificate for 127.0.0.1, returning the cert and key
+// files.
+func selfSigned(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestServePlaintextAndTLS(t *testing.T) {
+	certFile, keyFile := selfSigned(t)
+	configure(t, "-tls-cert", certFile, "-tls-key", keyFile)
+	plain, secure := freeAddr(t), freeAddr(t)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS != nil)
+	})}
+
+	done := make(chan error, 1)
+	go func() { done <- serve(server, []string{plain}, []string{secure}) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for url, want := range map[string]string{"http://" + plain + "/": "false", "https://" + secure + "/": "true"} {
+		url, want := url, want
+		eventually(t, func() bool {
+			res, err := client.Get(url)
+			if err != nil {
+				return false
+			}
+			defer res.Body.Close()
+			b, _ := ioutil.ReadAll(res.Body)
+			return string(b) == want
+		})
+	}
+
+	// Both listeners go when the server shuts down.
+	server.Close()
+	<-done
+	for _, addr := range []string{plain, secure} {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%s still listening", addr)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	certFile, keyFile := selfSigned(t)
+	configure(t, "-tls-cert", certFile, "-tls-key", keyFile, "-tls-min-version", "1.3")
+	config, err := newTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := freeAddr(t)
+	server := &http.Server{TLSConfig: config, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	})}
+	done := make(chan error, 1)
+	go func() { done <- serve(server, nil, []string{addr}) }()
+	defer func() {
+		server.Close()
+		<-done
+	}()
+
+	get := func(max uint16) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: max}}}
+		res, err := client.Get("https://" + addr + "/")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+	eventually(t, func() bool { return get(tls.VersionTLS13) == nil })
+	if err := get(tls.VersionTLS12); err == nil {
+		t.Error("TLS 1.2 client accepted with -tls-min-version 1.3")
+	}
+}
+
+func TestTLSConfigRefusesInsecureSettings(t *testing.T) {
+	for _, args := range [][]string{
+		{"-tls-min-version", "1.0"},
+		{"-tls-ciphers", "TLS_RSA_WITH_RC4_128_SHA"},
+		{"-tls-ciphers", "TLS_NOT_A_SUITE"},
+	} {
+		configure(t, args...)
+		if _, err := newTLSConfig(); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+
+	configure(t, "-tls-ciphers", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	config, err := newTLSConfig()
+	if err != nil || len(config.CipherSuites) != 1 || config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got %+v, %v", config, err)
+	}
+}
+
+// Runs main in a child process with args, for checking what it prints and how
+// it exits.
+func runMain(t *testing.T, args ...string) (string, string, error) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$", "--")
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Env = append(os.Environ(), "AMALGEMATE_TEST_MAIN=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+func TestMainProcess(t *testing.T) {
+	if os.Getenv("AMALGEMATE_TEST_MAIN") == "" {
+		t.Skip("only run by runMain")
+	}
+	for i, arg := range os.Args {
+		if arg == "--" {
+			os.Args = append([]string{os.Args[0]}, os.Args[i+1:]...)
+			break
+		}
+	}
+	main()
+}
+
+func TestCheckConfig(t *testing.T) {
+	out, _, err := runMain(t, "-check-config", "-repo", "https://gems.example.com/")
+	if err != nil || !strings.Contains(out, "Configuration OK") {
+		t.Errorf("good config got %v: %s", err, out)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-check-config"}, "Need at least one repository"},
+		{[]string{"-check-config", "-repo", "https://gems.example.com/", "-merge", "random"}, `Unknown merge strategy "random"`},
+		{[]string{"-check-config", "-repo", "https://gems.example.com/", "-tls-addr", ":8443", "-tls-cert", missing, "-tls-key", missing}, "Invalid -tls-cert or -tls-key"},
+		{[]string{"-check-config", "-repo", "https://gems.example.com/", "-trusted-proxies", "not-a-cidr"}, "Invalid -trusted-proxies"},
+	} {
+		out, _, err := runMain(t, c.args...)
+		if err == nil || !strings.Contains(out, c.want) {
+			t.Errorf("%v got %v: %s", c.args, err, out)
+		}
+		if strings.Contains(out, "Configuration OK") || strings.Contains(out, "Listening") {
+			t.Errorf("%v went on after a bad config: %s", c.args, out)
+		}
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "2.0.0"), gem("rails", "7.0.0", "rack >= 1"))
+	stdout, stderr, err := runMain(t, "-trace-gem", "rack", "-repo", first.URL, "-repo", second.URL, "query", "rails", "rack")
+	if err != nil {
+		t.Fatalf("got %v: %s", err, stderr)
+	}
+
+	var printed []struct {
+		Name         string     `json:"name"`
+		Number       string     `json:"number"`
+		Source       string     `json:"source"`
+		Dependencies [][]string `json:"dependencies"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &printed); err != nil {
+		t.Fatalf("%s printing %q", err, stdout)
+	}
+	var got []string
+	for _, p := range printed {
+		got = append(got, p.Name+"-"+p.Number+"@"+p.Source)
+	}
+	if !equalStrings(got, []string{"rack-1.0.0@" + first.URL, "rails-7.0.0@" + second.URL, "rack-2.0.0@" + second.URL}) {
+		t.Errorf("printed %v", got)
+	}
+	if !strings.Contains(stderr, "TRACE rack: ") {
+		t.Errorf("logged %q", stderr)
+	}
+
+	if _, _, err := runMain(t, "-repo", first.URL, "query"); err == nil {
+		t.Error("query without gems succeeded")
+	}
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	for _, c := range []struct {
+		arg  string
+		want time.Duration
+	}{
+		{"0", 0},
+		{"30s", 30 * time.Second},
+		{"-1s", -time.Second},
+	} {
+		configure(t, "-tcp-keepalive", c.arg)
+		if got := listenConfig().KeepAlive; got != c.want {
+			t.Errorf("-tcp-keepalive %s listens with %s", c.arg, got)
+		}
+	}
+}
+
+func TestBundlerFallsBackToDependencyAPI(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+	mux := http.NewServeMux()
+	routes(mux)
+
+	// What Bundler tries before the dependency API. Anything but a 404
+	// could be taken for a compact index.
+	for _, p := range []string{"/versions", "/info/rack", "/names", "/api/v2/versions", "/api/v2/rubygems/rack/versions/1.0.0.json", "/api/v1/versions/rack.json"} {
+		w := request(mux.ServeHTTP, "GET", p, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s got %d, Location %q", p, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// Bundler checks the dependency API answers without gems= before using it.
+	if w := request(mux.ServeHTTP, "GET", "/api/v1/dependencies", ""); w.Code != http.StatusOK {
+		t.Errorf("/api/v1/dependencies got %d", w.Code)
+	}
+	if w := request(mux.ServeHTTP, "GET", dependencies("rack"), ""); w.Code != http.StatusOK || !equalStrings(idents(decodeDeps(t, w.Body.Bytes())), []string{"rack-1.0.0"}) {
+		t.Errorf("dependencies got %d", w.Code)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// Maintenance mode, toggled through /admin/maintenance, drains upstream load:
+// whatever can be answered from the cache or gemDir still is, and anything
+// that would have to ask the repos gets a 503.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+var maintenance atomic.Bool
+
+var errMaintenance = errors.New("in maintenance, only cached results are served")
+
+func writeMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfterFlag.Seconds())))
+	http.Error(w, "Down for maintenance", http.StatusServiceUnavailable)
+}
+
+// GET reports whether maintenance mode is on, POST with enabled=true or false
+// switches it.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		maintenance.Store(enabled)
+		fmt.Println("Maintenance mode enabled:", enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": maintenance.Load()})
+}
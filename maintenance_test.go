@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"), gem("rails", "7.0.0"))
+	configure(t, "-admin-token", testAdminToken, "-cache-ttl", "10ms", "-stale-while-revalidate", "1h", "-maintenance-retry-after", "2m", "-repo", repo.URL)
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+
+	if w := admin(handleMaintenance, "POST", "/admin/maintenance?enabled=true", ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	n := repo.requestCount()
+	w := request(handleDependencies, "GET", dependencies("rails"), "")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "120" {
+		t.Errorf("cache miss got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Cache hits are still served, stale ones without a refresh.
+	time.Sleep(20 * time.Millisecond)
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK {
+		t.Errorf("cache hit got %d", w.Code)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if repo.requestCount() != n {
+		t.Error("repo asked in maintenance")
+	}
+
+	admin(handleMaintenance, "POST", "/admin/maintenance?enabled=false", "")
+	if w := request(handleDependencies, "GET", dependencies("rails"), ""); w.Code != http.StatusOK {
+		t.Errorf("after maintenance got %d", w.Code)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+// Metrics, sent to Prometheus and served at /metrics by default.
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricShadowedGems          = "shadowed_gems"
+	metricDivergentDependencies = "divergent_dependencies"
+	metricSuspectEmptyResponses = "suspect_empty_responses"
+	metricResponseBytes         = "response_bytes"
+	metricCacheHitBytes         = "cache_hit_bytes"
+	metricNotModifiedBytes      = "not_modified_bytes"
+	metricPrimaryMissed         = "primary_missed"
+	metricEmptyMerges           = "empty_merges"
+)
+
+// Where metrics are sent. The code recording them only deals with this, so
+// another backend such as StatsD only needs an implementation of it.
+type metricsSink interface {
+	add(metric string, delta float64, labels ...string)
+	observe(metric string, value float64, labels ...string)
+}
+
+var metrics metricsSink = prometheusSink{}
+
+type prometheusSink struct{}
+
+func (prometheusSink) add(metric string, delta float64, labels ...string) {
+	if c, ok := promCounters[metric]; ok {
+		c.WithLabelValues(labels...).Add(delta)
+	}
+}
+
+func (prometheusSink) observe(metric string, value float64, labels ...string) {
+	if h, ok := promHistograms[metric]; ok {
+		h.WithLabelValues(labels...).Observe(value)
+	}
+}
+
+var promCounters = map[string]*prometheus.CounterVec{
+	metricShadowedGems: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_shadowed_gems_total",
+		Help: "Gem versions dropped from a merge because a higher priority repo already provided them.",
+	}, []string{"winner", "loser"}),
+
+	metricDivergentDependencies: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_divergent_dependencies_total",
+		Help: "Gem versions found in two repos with different dependencies. The winner's dependencies are served.",
+	}, []string{"winner", "loser"}),
+
+	metricSuspectEmptyResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_suspect_empty_responses_total",
+		Help: "Empty answers from a repo to a query other repos had results for, counted with -warn-empty-responses.",
+	}, []string{"repo"}),
+
+	metricPrimaryMissed: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_primary_missed_total",
+		Help: "Gem versions left out of a -primary-then-verify quick answer, by the repo that has them.",
+	}, []string{"repo"}),
+
+	metricEmptyMerges: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_empty_merges_total",
+		Help: "Queries for several gems that no repo had any version of.",
+	}, nil),
+
+	metricCacheHitBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_cache_hit_bytes_total",
+		Help: "Estimated encoded size of the dependency results served from the cache rather than fetched.",
+	}, nil),
+
+	metricNotModifiedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "amalgemate_not_modified_bytes_total",
+		Help: "Response body bytes not sent because the client's copy was current.",
+	}, nil),
+}
+
+var promHistograms = map[string]*prometheus.HistogramVec{
+	metricResponseBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "amalgemate_response_bytes",
+		Help:    "Size of successful response bodies.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"endpoint"}),
+}
+
+// Read when scraped, so it's Prometheus only.
+var cacheMemoryBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "amalgemate_cache_memory_bytes",
+	Help: "Estimated size of the dependency cache entries held in memory.",
+}, func() float64 {
+	if c, ok := depCache.(*cache); ok {
+		return float64(c.memoryBytes())
+	}
+	return 0
+})
+
+func init() {
+	for _, c := range promCounters {
+		prometheus.MustRegister(c)
+	}
+	for _, h := range promHistograms {
+		prometheus.MustRegister(h)
+	}
+	prometheus.MustRegister(cacheMemoryBytes)
+}
+
+// Records the size of the handler's successful responses.
+func measured(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lw := &loggingWriter{ResponseWriter: w}
+		h(lw, r)
+		if lw.status == http.StatusOK {
+			metrics.observe(metricResponseBytes, float64(lw.bytes), endpoint)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSizeMetrics(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	m := configure(t, "-cache-ttl", "1h", "-repo", repo.URL)
+	h := measured("dependencies", handleDependencies)
+
+	w := request(h, "GET", dependencies("rack"), "")
+	if got := m.count(metricResponseBytes, "dependencies"); got != float64(w.Body.Len()) {
+		t.Errorf("recorded %v bytes, sent %d", got, w.Body.Len())
+	}
+	if m.count(metricCacheHitBytes) != 0 {
+		t.Error("cache hit bytes recorded for a miss")
+	}
+	if n := depCache.(*cache).memoryBytes(); n <= 0 {
+		t.Errorf("cache holds %d bytes", n)
+	}
+
+	request(h, "GET", dependencies("rack"), "")
+	if m.count(metricCacheHitBytes) <= 0 {
+		t.Error("no cache hit bytes recorded")
+	}
+
+	// A 304 isn't a response size, but its body is saved.
+	notModified := request(h, "GET", dependencies("rack"), "", "If-None-Match", w.Header().Get("ETag"))
+	if notModified.Code != http.StatusNotModified {
+		t.Fatalf("got %d", notModified.Code)
+	}
+	if got := m.count(metricNotModifiedBytes); got != float64(w.Body.Len()) {
+		t.Errorf("recorded %v bytes saved, body is %d", got, w.Body.Len())
+	}
+	if got := m.count(metricResponseBytes, "dependencies"); got != float64(2*w.Body.Len()) {
+		t.Errorf("recorded %v bytes over two responses of %d", got, w.Body.Len())
+	}
+}
+
+func TestQueryMetrics(t *testing.T) {
+	first := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 2"), gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"), gem("rack", "1.0.0"))
+	empty := newFakeRepo(t)
+	m := configure(t, "-warn-empty-responses", "-repo", first.URL, "-repo", second.URL, "-repo", empty.URL)
+	if _, err := depQuery([]string{"rails", "rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	winner, loser := reposFlag[0].public(), reposFlag[1].public()
+	for _, c := range []struct {
+		metric string
+		labels []string
+		want   float64
+	}{
+		{metricShadowedGems, []string{winner, loser}, 2},
+		{metricDivergentDependencies, []string{winner, loser}, 1},
+		{metricSuspectEmptyResponses, []string{reposFlag[2].public()}, 1},
+		{metricCacheHitBytes, nil, 0},
+	} {
+		if got := m.count(c.metric, c.labels...); got != c.want {
+			t.Errorf("%s %v is %v, want %v", c.metric, c.labels, got, c.want)
+		}
+	}
+}
+
+func TestPrometheusSinkIgnoresUnknownMetrics(t *testing.T) {
+	prometheusSink{}.add("no_such_metric", 1)
+	prometheusSink{}.observe("no_such_metric", 1)
+}
@@ -0,0 +1,42 @@
+package main
+
+// The query subcommand, which resolves gems against the configured repos and
+// prints the merged result instead of starting the server:
+//
+//	amalgemate -repo https://rubygems.org/ query rails rack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+func runQuery(gems []string) {
+	// Everything logged while querying goes to stderr, leaving stdout for the
+	// JSON so it can be piped somewhere.
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	if len(gems) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: amalgemate [flags] query GEM...")
+		os.Exit(1)
+	}
+
+	deps, ok, err := boundedQuery(gems, defaultOptions())
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Query exceeded -request-timeout of %s\n", requestTimeoutFlag)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(jsonDependencies(deps, false)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,330 @@
+package main
+
+// Upstream repositories and their per-repo settings.
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultDepsPath = "api/v1/dependencies"
+
+// An upstream RubyGems repository. Besides its URL a repo may carry settings,
+// given as comma separated key=value pairs after the URL on the command line:
+//
+//	-repo https://gems.example.com/,deps-path=mirror/api/v1/dependencies
+type repository struct {
+	*url.URL
+	depsPath string
+	// Where gems are downloaded from, if not the repo itself.
+	downloadBase *url.URL
+	// Gem name patterns that may only ever be served from this repo.
+	pins []string
+	// Gem name patterns this repo is queried for. A repo with routes is only
+	// asked about gems matching them, and those gems aren't asked of repos
+	// without a matching route.
+	routes []string
+	// Names this repo publishes gems under, keyed by the name they're served
+	// as.
+	aliases map[string]string
+	// Limits this repo's requests in flight, nil when only the global
+	// -max-upstream-requests applies.
+	sem chan struct{}
+	// Sent as the Accept header of dependency requests, in place of
+	// -upstream-accept.
+	accept string
+	// Sent with every dependency request to this repo, alongside gems=.
+	params url.Values
+	// Bounds each dependency request to this repo, zero when unbounded.
+	timeout time.Duration
+
+	health repoHealth
+}
+
+// The options parseRepo understands after a repo's URL.
+var repoOptions = map[string]bool{
+	"deps-path": true, "download-base": true, "pin": true, "route": true, "alias": true,
+	"param": true, "timeout": true, "accept": true, "max-requests": true,
+}
+
+func parseRepo(v string) (*repository, error) {
+	parts := strings.Split(v, ",")
+
+	u, err := url.Parse(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	r := &repository{URL: u, depsPath: defaultDepsPath}
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid option %q for repo %s", opt, redactURL(u))
+		}
+
+		switch kv[0] {
+		case "deps-path":
+			r.depsPath = kv[1]
+		case "download-base":
+			if r.downloadBase, err = url.Parse(kv[1]); err != nil {
+				return nil, err
+			}
+		case "pin", "route":
+			if _, err := path.Match(kv[1], ""); err != nil {
+				return nil, fmt.Errorf("invalid %s %q for repo %s: %s", kv[0], kv[1], redactURL(u), err)
+			}
+			if kv[0] == "pin" {
+				r.pins = append(r.pins, kv[1])
+			} else {
+				r.routes = append(r.routes, kv[1])
+			}
+		case "alias":
+			names := strings.SplitN(kv[1], ":", 2)
+			if len(names) != 2 || names[0] == "" || names[1] == "" {
+				return nil, fmt.Errorf("invalid alias %q for repo %s, expected name:published-name", kv[1], redactURL(u))
+			}
+			if r.aliases == nil {
+				r.aliases = make(map[string]string)
+			}
+			r.aliases[names[0]] = names[1]
+		case "param":
+			param := strings.SplitN(kv[1], ":", 2)
+			if len(param) != 2 || param[0] == "" || param[0] == "gems" {
+				return nil, fmt.Errorf("invalid param %q for repo %s, expected name:value", kv[1], redactURL(u))
+			}
+			if r.params == nil {
+				r.params = make(url.Values)
+			}
+			r.params.Add(param[0], param[1])
+		case "timeout":
+			if r.timeout, err = time.ParseDuration(kv[1]); err != nil || r.timeout <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q for repo %s", kv[1], redactURL(u))
+			}
+		case "accept":
+			r.accept = kv[1]
+		case "max-requests":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid max-requests %q for repo %s", kv[1], redactURL(u))
+			}
+			r.sem = make(chan struct{}, n)
+		default:
+			return nil, fmt.Errorf("unknown option %q for repo %s", kv[0], redactURL(u))
+		}
+	}
+
+	return r, nil
+}
+
+// Resolves a path relative to the repo, regardless of whether either has a
+// leading or trailing slash.
+func (r *repository) endpoint(p string) *url.URL {
+	u := *r.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	u.RawPath = ""
+	return &u
+}
+
+// Resolves the download URL of a file from the repo.
+func (r *repository) download(p string) *url.URL {
+	p = r.unalias(p)
+	if r.downloadBase == nil {
+		return r.endpoint(p)
+	}
+	return (&repository{URL: r.downloadBase}).endpoint(p)
+}
+
+// Adds the names the repo publishes any of the gems under.
+func (r *repository) withAliases(gems []string) []string {
+	if len(r.aliases) == 0 {
+		return gems
+	}
+	out := append([]string(nil), gems...)
+	for _, gem := range gems {
+		if published, ok := r.aliases[gem]; ok {
+			out = append(out, published)
+		}
+	}
+	return out
+}
+
+// Presents gems published under an alias by the name they're served as.
+func (r *repository) canonicalize(deps []gemInfo) []gemInfo {
+	for i := range deps {
+		for name, published := range r.aliases {
+			if deps[i].Name == published {
+				deps[i].Name = name
+				break
+			}
+		}
+	}
+	return deps
+}
+
+// Maps a file named for an aliased gem back to the name the repo has it
+// under. Versions start with a digit, which tells foo-1.0.gem apart from
+// foo-bar-1.0.gem.
+func (r *repository) unalias(p string) string {
+	dir, file := path.Split(p)
+	for name, published := range r.aliases {
+		rest := strings.TrimPrefix(file, name+"-")
+		if rest != file && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			return dir + published + "-" + rest
+		}
+	}
+	return p
+}
+
+// Repo URLs may carry credentials, which must never be handed to clients.
+func (r *repository) public() string {
+	if r == nil {
+		return ""
+	}
+	return redactURL(r.URL)
+}
+
+func redactURL(u *url.URL) string {
+	c := *u
+	c.User = nil
+	return c.String()
+}
+
+type repos []*repository
+
+func (s *repos) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *repos) Set(v string) error {
+	r, err := parseRepo(v)
+	if err != nil {
+		return err
+	}
+
+	*s = append(*s, r)
+	return nil
+}
+
+// Parses a comma separated list of repos, as given in AMALGEMATE_REPOS.
+// Options for a repo follow its URL just as they do on -repo, so any item
+// that isn't a URL belongs to the repo before it. So does a known option
+// whose value is a URL, like download-base.
+func parseRepoList(v string) (repos, error) {
+	var specs []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		kv := strings.SplitN(item, "=", 2)
+		isOption := len(kv) == 2 && repoOptions[kv[0]]
+		switch {
+		case item == "":
+		case strings.Contains(item, "://") && !isOption || len(specs) == 0:
+			specs = append(specs, item)
+		default:
+			specs[len(specs)-1] += "," + item
+		}
+	}
+
+	var list repos
+	for _, spec := range specs {
+		if err := list.Set(spec); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Returns the repo the gem is pinned to, if any.
+func (s repos) pinned(name string) *repository {
+	for _, r := range s {
+		for _, pattern := range r.pins {
+			if ok, _ := path.Match(pattern, name); ok {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func (r *repository) routed(name string) bool {
+	for _, pattern := range r.routes {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the gems that should be asked of the repo, per the routing rules.
+func (s repos) gemsFor(r *repository, gems []string) []string {
+	var out []string
+	for _, gem := range gems {
+		if r.routed(gem) {
+			out = append(out, gem)
+			continue
+		}
+		if len(r.routes) > 0 {
+			continue
+		}
+
+		if !s.claimed(gem) {
+			out = append(out, gem)
+		}
+	}
+	return out
+}
+
+// Whether any repo has a route matching the gem.
+func (s repos) claimed(gem string) bool {
+	for _, r := range s {
+		if r.routed(gem) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the repo may be asked for a file, per the routing rules. Which gem a
+// file belongs to can't be told for certain from its name, so every name it
+// could be is considered, and a routed gem's file is never asked of a repo it
+// isn't routed to.
+func (s repos) mayProbe(r *repository, file string) bool {
+	var names []string
+	for i := 0; i+1 < len(file); i++ {
+		if file[i] == '-' && file[i+1] >= '0' && file[i+1] <= '9' {
+			names = append(names, file[:i])
+		}
+	}
+
+	matched := false
+	for _, name := range names {
+		if r.routed(name) {
+			matched = true
+		} else if s.claimed(name) {
+			return false
+		}
+	}
+	return matched || len(r.routes) == 0
+}
+
+// Finds the configured repo with the given public URL.
+func (s repos) find(u string) *repository {
+	for _, r := range s {
+		if r.public() == u {
+			return r
+		}
+	}
+	return nil
+}
+
+// Finds a configured repo by public URL, whether it's a primary or a
+// fallback.
+func findRepo(u string) *repository {
+	if r := reposFlag.find(u); r != nil {
+		return r
+	}
+	return fallbackReposFlag.find(u)
+}
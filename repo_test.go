@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustParseRepo(t *testing.T, v string) *repository {
+	t.Helper()
+	r, err := parseRepo(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestEndpoint(t *testing.T) {
+	for _, c := range []struct {
+		repo, path, want string
+	}{
+		{"https://gems.example.com", "api/v1/dependencies", "https://gems.example.com/api/v1/dependencies"},
+		{"https://gems.example.com/", "/api/v1/dependencies", "https://gems.example.com/api/v1/dependencies"},
+		{"https://example.com/mirror/", "api/v1/dependencies", "https://example.com/mirror/api/v1/dependencies"},
+		{"https://example.com/mirror", "/deps", "https://example.com/mirror/deps"},
+	} {
+		if got := mustParseRepo(t, c.repo).endpoint(c.path).String(); got != c.want {
+			t.Errorf("%s + %s = %s, want %s", c.repo, c.path, got, c.want)
+		}
+	}
+}
+
+func TestCustomDepsPath(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL+"/,deps-path=/mirror/api/v1/dependencies")
+
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 {
+		t.Errorf("got %v", idents(deps))
+	}
+	if p := repo.lastRequest().URL.Path; p != "/mirror/api/v1/dependencies" {
+		t.Errorf("asked %s", p)
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	plain := newFakeRepo(t, gem("rack", "1.0.0"))
+	picky := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", plain.URL, "-repo", picky.URL+",accept=application/octet-stream")
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if got := plain.lastRequest().Header.Get("Accept"); got != "*/*" {
+		t.Errorf("default Accept %q", got)
+	}
+	if got := picky.lastRequest().Header.Get("Accept"); got != "application/octet-stream" {
+		t.Errorf("repo's Accept %q", got)
+	}
+
+	configure(t, "-upstream-accept", "application/x-marshal", "-repo", plain.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if got := plain.lastRequest().Header.Get("Accept"); got != "application/x-marshal" {
+		t.Errorf("-upstream-accept sent %q", got)
+	}
+}
+
+func TestRepoParams(t *testing.T) {
+	tenant := newFakeRepo(t, gem("rack", "1.0.0"))
+	plain := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", tenant.URL+",param=tenant:a&b=c,param=channel:stable,param=channel:edge", "-repo", plain.URL)
+	if _, err := depQuery([]string{"rack", "rails"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	q := tenant.lastRequest().URL.Query()
+	if q.Get("tenant") != "a&b=c" || !equalStrings(q["channel"], []string{"stable", "edge"}) || q.Get("gems") != "rack,rails" {
+		t.Errorf("asked with %v", q)
+	}
+	if q := plain.lastRequest().URL.Query(); len(q) != 1 || q.Get("gems") != "rack,rails" {
+		t.Errorf("other repo asked with %v", q)
+	}
+
+	for _, v := range []string{"https://gems.example.com/,param=tenant", "https://gems.example.com/,param=gems:rack", "https://gems.example.com/,param=:x"} {
+		if _, err := parseRepo(v); err == nil {
+			t.Errorf("%s accepted", v)
+		}
+	}
+}
+
+func TestRepoTimeout(t *testing.T) {
+	primary := newFakeRepo(t, gem("rack", "1.0.0"))
+	fallback := newFakeRepo(t, gem("rack", "1.0.0"))
+	primary.setLatency(50 * time.Millisecond)
+	fallback.setLatency(50 * time.Millisecond)
+	configure(t, "-repo", primary.URL+",timeout=5s", "-repo", fallback.URL+",timeout=10ms")
+
+	if deps, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err != nil || len(deps) != 1 {
+		t.Errorf("primary got %v, %v", idents(deps), err)
+	}
+	start := time.Now()
+	_, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[1])
+	if err == nil || !strings.Contains(err.Error(), "within its timeout of 10ms") {
+		t.Errorf("fallback got %v", err)
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("fallback took %s", d)
+	}
+
+	for _, v := range []string{"https://gems.example.com/,timeout=soon", "https://gems.example.com/,timeout=0s", "https://gems.example.com/,timeout=-1s"} {
+		if _, err := parseRepo(v); err == nil {
+			t.Errorf("%s accepted", v)
+		}
+	}
+}
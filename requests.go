@@ -0,0 +1,119 @@
+package main
+
+// Tracks in-flight and recently finished requests for /debug/requests, to see
+// what a live server is busy with.
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many finished requests are kept.
+const recentRequests = 100
+
+type tracedRequest struct {
+	Method  string        `json:"method"`
+	Path    string        `json:"path"`
+	Gems    int64         `json:"gems,omitempty"`
+	Started time.Time     `json:"started"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+	Status  int           `json:"status,omitempty"`
+}
+
+var requestTrace = struct {
+	sync.Mutex
+	inFlight map[*tracedRequest]bool
+	recent   [recentRequests]*tracedRequest
+	next     int
+}{inFlight: make(map[*tracedRequest]bool)}
+
+type traceKey struct{}
+
+func traceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health checks and metrics scrapes would push everything else out.
+		if logExcluded(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		t := &tracedRequest{Method: r.Method, Path: r.URL.Path, Started: time.Now()}
+		requestTrace.Lock()
+		requestTrace.inFlight[t] = true
+		requestTrace.Unlock()
+
+		lw := &loggingWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r.WithContext(context.WithValue(r.Context(), traceKey{}, t)))
+
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestTrace.Lock()
+		delete(requestTrace.inFlight, t)
+		t.Status = status
+		t.Elapsed = time.Since(t.Started)
+		requestTrace.recent[requestTrace.next] = t
+		requestTrace.next = (requestTrace.next + 1) % recentRequests
+		requestTrace.Unlock()
+	})
+}
+
+// Notes how many gems a request asked about, once they're known.
+func traceGems(r *http.Request, n int) {
+	if t, ok := r.Context().Value(traceKey{}).(*tracedRequest); ok {
+		atomic.StoreInt64(&t.Gems, int64(n))
+	}
+}
+
+// The finished requests kept, newest first.
+func recentTraced() []tracedRequest {
+	requestTrace.Lock()
+	defer requestTrace.Unlock()
+
+	var recent []tracedRequest
+	for i := 1; i <= recentRequests; i++ {
+		t := requestTrace.recent[(requestTrace.next-i+recentRequests)%recentRequests]
+		if t == nil {
+			break
+		}
+		recent = append(recent, *t)
+	}
+	return recent
+}
+
+func handleDebugRequests(w http.ResponseWriter, r *http.Request) {
+	out := struct {
+		InFlight []tracedRequest `json:"in_flight"`
+		Recent   []tracedRequest `json:"recent"`
+	}{
+		InFlight: []tracedRequest{},
+		Recent:   []tracedRequest{},
+	}
+
+	requestTrace.Lock()
+	now := time.Now()
+	for t := range requestTrace.inFlight {
+		out.InFlight = append(out.InFlight, tracedRequest{
+			Method:  t.Method,
+			Path:    t.Path,
+			Gems:    atomic.LoadInt64(&t.Gems),
+			Started: t.Started,
+			Elapsed: now.Sub(t.Started),
+		})
+	}
+	requestTrace.Unlock()
+	out.Recent = append(out.Recent, recentTraced()...)
+
+	sort.Slice(out.InFlight, func(i, j int) bool {
+		return out.InFlight[i].Started.Before(out.InFlight[j].Started)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func debugRequests(t *testing.T) (inFlight, recent []tracedRequest) {
+	t.Helper()
+	w := admin(handleDebugRequests, "GET", "/debug/requests", "")
+	var out struct {
+		InFlight []tracedRequest `json:"in_flight"`
+		Recent   []tracedRequest `json:"recent"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s decoding %s", err, w.Body)
+	}
+	return out.InFlight, out.Recent
+}
+
+func TestDebugRequests(t *testing.T) {
+	configure(t, "-admin-token", testAdminToken)
+	started, release := make(chan struct{}), make(chan struct{})
+	h := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceGems(r, 3)
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", dependencies("rack", "rails", "thor"), nil))
+		close(done)
+	}()
+	<-started
+
+	inFlight, _ := debugRequests(t)
+	if len(inFlight) != 1 || inFlight[0].Path != "/api/v1/dependencies" || inFlight[0].Gems != 3 {
+		t.Errorf("in flight %+v", inFlight)
+	}
+
+	close(release)
+	<-done
+	inFlight, recent := debugRequests(t)
+	if len(inFlight) != 0 {
+		t.Errorf("still in flight %+v", inFlight)
+	}
+	if len(recent) == 0 || recent[0].Path != "/api/v1/dependencies" || recent[0].Status != http.StatusAccepted || recent[0].Gems != 3 {
+		t.Errorf("recent %+v", recent)
+	}
+
+	// Health checks aren't traced.
+	h = traceRequests(http.NotFoundHandler())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	if _, after := debugRequests(t); len(after) != len(recent) {
+		t.Errorf("recent grew to %+v", after)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+// Says where each gem a Gemfile.lock pins will be downloaded from, so CI can
+// check a whole lockfile's sources in one request.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A gem at the version a lockfile pins. The version carries the platform,
+// as lockfiles write it, so name-version is the gem's ident.
+type lockedGem struct {
+	name    string
+	version string
+}
+
+// Locked specs are indented four spaces beneath a GEM section's specs:.
+var lockedSpec = regexp.MustCompile(`^    ([^ (]+) \(([^)]+)\)$`)
+
+// Reads the gems pinned by the GEM sections of a Gemfile.lock. Gems from GIT
+// and PATH sections don't come from a repo, so they're left out.
+func parseLockfile(r io.Reader) ([]lockedGem, error) {
+	var gems []lockedGem
+	inGem := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && line[0] != ' ' {
+			inGem = line == "GEM"
+			continue
+		}
+		if m := lockedSpec.FindStringSubmatch(line); inGem && m != nil {
+			gems = append(gems, lockedGem{name: m[1], version: m[2]})
+		}
+	}
+	return gems, scanner.Err()
+}
+
+type resolvedGem struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Found   bool     `json:"found"`
+	Source  string   `json:"source,omitempty"`
+	Mirrors []string `json:"mirrors,omitempty"`
+}
+
+// Takes a Gemfile.lock, or a JSON object of gem names to versions, and
+// answers with the repo each pinned version would be served from.
+func handleResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := io.LimitReader(r.Body, 10<<20)
+	var locked []lockedGem
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var manifest map[string]string
+		if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+			http.Error(w, "Invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, version := range manifest {
+			locked = append(locked, lockedGem{name: name, version: version})
+		}
+		sort.Slice(locked, func(i, j int) bool { return locked[i].name < locked[j].name })
+	} else {
+		var err error
+		if locked, err = parseLockfile(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(locked) == 0 {
+		http.Error(w, "No locked gems given", http.StatusBadRequest)
+		return
+	}
+
+	// Checked as gems= names are, so a lockfile can't ask the repos for
+	// anything a dependencies query couldn't.
+	seen := make(map[string]bool)
+	var names []string
+	for i, gem := range locked {
+		split, err := splitGemNames(gem.name)
+		if err == nil && len(split) != 1 {
+			err = fmt.Errorf("invalid gem name %q", gem.name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		gem.name = split[0]
+		locked[i] = gem
+		if !seen[gem.name] {
+			seen[gem.name] = true
+			names = append(names, gem.name)
+		}
+	}
+
+	opts := requestOptions(r)
+	deps, ok, err := boundedQuery(names, opts)
+	if !ok {
+		fmt.Printf("Resolve query exceeded its timeout of %s\n", opts.timeout)
+		http.Error(w, "Timed out waiting for upstream repositories", http.StatusGatewayTimeout)
+		return
+	}
+	if err == errMaintenance {
+		writeMaintenance(w)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	byIdent := make(map[string]gemInfo, len(deps))
+	for _, dep := range deps {
+		byIdent[dep.ident()] = dep
+	}
+
+	out := make([]resolvedGem, len(locked))
+	for i, gem := range locked {
+		out[i] = resolvedGem{Name: gem.name, Version: gem.version}
+		dep, ok := byIdent[gem.name+"-"+gem.version]
+		if !ok {
+			continue
+		}
+		out[i].Found = true
+		out[i].Source = dep.repo.public()
+		for _, mirror := range dep.mirrors {
+			out[i].Mirrors = append(out[i].Mirrors, mirror.public())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func resolve(t *testing.T, body string, headers ...string) []resolvedGem {
+	t.Helper()
+	w := request(handleResolve, "POST", "/resolve", body, headers...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	var out []resolvedGem
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatalf("%s decoding %s", err, w.Body)
+	}
+	return out
+}
+
+func TestResolveLockfile(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"), gem("rails", "6.1.0", "rack >= 1"))
+	configure(t, "-repo", first.URL, "-repo", second.URL)
+
+	got := resolve(t, testLockfile)
+	want := []resolvedGem{
+		{Name: "rack", Version: "1.0.0", Found: true, Source: first.URL, Mirrors: []string{second.URL}},
+		{Name: "rails", Version: "7.0.0"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v", got)
+	}
+	for i := range want {
+		if got[i].Name != want[i].Name || got[i].Version != want[i].Version || got[i].Found != want[i].Found ||
+			got[i].Source != want[i].Source || !equalStrings(got[i].Mirrors, want[i].Mirrors) {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+	// The GIT section's gem doesn't come from a repo.
+	if asked := first.asked(); len(asked) != 1 || !equalStrings(asked[0], []string{"rack", "rails"}) {
+		t.Errorf("asked %v", asked)
+	}
+}
+
+func TestResolveManifest(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"), gem("rails", "7.0.0", "rack >= 1"))
+	configure(t, "-normalize-gem-names", "-repo", repo.URL)
+
+	got := resolve(t, `{"Rails": "7.0.0", "rack/": "1.0.0"}`, "Content-Type", "application/json")
+	// Sorted by the names as given, before they're normalized.
+	if len(got) != 2 || got[0].Name != "rails" || !got[0].Found || got[0].Source != repo.URL || got[1].Name != "rack" || !got[1].Found {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestResolveRefusesInvalidNames(t *testing.T) {
+	repo := newFakeRepo(t)
+	configure(t, "-repo", repo.URL)
+
+	for _, manifest := range []string{`{"../etc": "1.0.0"}`, `{"rack,rails": "1.0.0"}`, `{"": "1.0.0"}`, `{"Rack/": "1.0.0"}`} {
+		if w := request(handleResolve, "POST", "/resolve", manifest, "Content-Type", "application/json"); w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d", manifest, w.Code)
+		}
+	}
+	if n := repo.requestCount(); n != 0 {
+		t.Errorf("repo asked %d times", n)
+	}
+}
+
+func TestResolveTimeout(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(time.Second)
+	configure(t, "-request-timeout", "30ms", "-repo", repo.URL)
+
+	start := time.Now()
+	w := request(handleResolve, "POST", "/resolve", `{"rack": "1.0.0"}`, "Content-Type", "application/json")
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("got %d", w.Code)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("took %s", d)
+	}
+}
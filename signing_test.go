@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignedRedirect(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-sign-key", "cdn-secret", "-sign-ttl", "10m", "-repo", repo.URL+",download-base=https://cdn.example.com/mirror/")
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusFound {
+		t.Errorf("signed redirect sent as %d", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Host != "cdn.example.com" || loc.Path != "/mirror/gems/rack-1.0.0.gem" {
+		t.Errorf("redirected to %s", loc)
+	}
+
+	expires := loc.Query().Get("expires")
+	n, err := strconv.ParseInt(expires, 10, 64)
+	if d := time.Until(time.Unix(n, 0)); err != nil || d < 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("expires %q, in %s", expires, d)
+	}
+	mac := hmac.New(sha256.New, []byte("cdn-secret"))
+	mac.Write([]byte("/mirror/gems/rack-1.0.0.gem\n" + expires))
+	if want := hex.EncodeToString(mac.Sum(nil)); loc.Query().Get("signature") != want {
+		t.Errorf("signature %q, want %q", loc.Query().Get("signature"), want)
+	}
+}
+
+func TestUnsignedRedirect(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if loc := w.Header().Get("Location"); w.Code != http.StatusMovedPermanently || loc != repo.URL+"/gems/rack-1.0.0.gem" {
+		t.Errorf("got %d to %s", w.Code, loc)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Snapshots of upstream dependency data, so builds can be reproduced against
+// exactly the data they saw before. In capture mode every upstream response is
+// recorded to -snapshot-dir, in serve mode the snapshot is served and
+// upstreams are never contacted.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotCapture = "capture"
+	snapshotServe   = "serve"
+)
+
+// Each repo gets its own directory, holding a file per gem name.
+func snapshotPath(repo *repository, name string) string {
+	// Without credentials, so rotating them doesn't orphan the snapshot.
+	sum := sha256.Sum256([]byte(repo.public()))
+	return filepath.Join(snapshotDirFlag, hex.EncodeToString(sum[:8]), name+".json")
+}
+
+// Records what the repo said about each of the requested gems, including
+// that it has none of some of them.
+func captureSnapshot(repo *repository, names []string, results []gemInfo) error {
+	byName := make(map[string][]gemInfo)
+	for _, name := range names {
+		byName[name] = []gemInfo{}
+	}
+	for _, dep := range results {
+		byName[dep.Name] = append(byName[dep.Name], dep)
+	}
+
+	for name, deps := range byName {
+		// Names come from clients and upstreams, and must not lead out of
+		// the snapshot.
+		if !validGemName.MatchString(name) {
+			continue
+		}
+		p := snapshotPath(repo, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		b, err := json.Marshal(deps)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gems missing from the snapshot are treated as absent from the repo.
+func loadSnapshot(repo *repository, names []string) ([]gemInfo, error) {
+	var results []gemInfo
+	for _, name := range names {
+		if !validGemName.MatchString(name) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(snapshotPath(repo, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var deps []gemInfo
+		if err := json.Unmarshal(b, &deps); err != nil {
+			return nil, err
+		}
+		for i := range deps {
+			deps[i].repo = repo
+		}
+		results = append(results, deps...)
+	}
+	return results, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotCaptureThenServe(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"), gem("rack", "2.0.0", "thor >= 1"))
+	second := newFakeRepo(t, gem("rails", "7.0.0", "rack >= 1"))
+	dir := t.TempDir()
+	args := []string{"-snapshot-dir", dir, "-repo", first.URL, "-repo", second.URL}
+
+	configure(t, append([]string{"-snapshot-mode", "capture"}, args...)...)
+	captured := request(handleDependencies, "GET", dependencies("rack", "rails", "missing"), "")
+	if captured.Code != http.StatusOK {
+		t.Fatalf("got %d", captured.Code)
+	}
+
+	first.fail(http.StatusInternalServerError)
+	second.fail(http.StatusInternalServerError)
+	asked := first.requestCount() + second.requestCount()
+	configure(t, append([]string{"-snapshot-mode", "serve"}, args...)...)
+	served := request(handleDependencies, "GET", dependencies("rack", "rails", "missing"), "")
+	if served.Code != http.StatusOK || !bytes.Equal(served.Body.Bytes(), captured.Body.Bytes()) {
+		t.Errorf("served %d %v, captured %v", served.Code, idents(decodeDeps(t, served.Body.Bytes())), idents(decodeDeps(t, captured.Body.Bytes())))
+	}
+	if n := first.requestCount() + second.requestCount(); n != asked {
+		t.Errorf("repos asked %d times serving the snapshot", n-asked)
+	}
+}
+
+func TestSnapshotNamesStayInDir(t *testing.T) {
+	repo := newFakeRepo(t)
+	repo.body = encodeDeps([]gemInfo{gem("../../escaped", "1.0.0")})
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "snapshot")
+	configure(t, "-snapshot-mode", "capture", "-snapshot-dir", dir, "-repo", repo.URL)
+
+	if _, err := loadDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && filepath.Base(p) == "escaped.json" {
+			t.Errorf("captured to %s", p)
+		}
+		return nil
+	})
+
+	configure(t, "-snapshot-mode", "serve", "-snapshot-dir", dir, "-repo", repo.URL)
+	deps, err := loadSnapshot(reposFlag[0], []string{"../../../a/snapshot/x", "rack"})
+	if err != nil || len(deps) != 0 {
+		t.Errorf("got %v, %v", idents(deps), err)
+	}
+}
+
+func TestSnapshotServeNeverContactsRepos(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.serveFile("gems/rack-1.0.0.gem", []byte("gem"))
+	repo.serveFile(quickPrefix+"rack-1.0.0.gemspec.rz", []byte("spec"))
+	dir := t.TempDir()
+	configure(t, "-snapshot-mode", "capture", "-snapshot-dir", dir, "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	asked := repo.requestCount()
+	for _, proxy := range []string{"-proxy-downloads=false", "-proxy-downloads"} {
+		configure(t, "-snapshot-mode", "serve", "-snapshot-dir", dir, proxy, "-repo", repo.URL)
+		if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Code != http.StatusOK || len(decodeDeps(t, w.Body.Bytes())) != 1 {
+			t.Errorf("%s dependencies got %d", proxy, w.Code)
+		}
+		request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+		request(handleGem, "GET", "/gems/rails-7.0.0.gem", "")
+		request(handleQuick, "GET", "/"+quickPrefix+"rack-1.0.0.gemspec.rz", "")
+		request(handleQuick, "GET", "/"+quickPrefix+"rails-7.0.0.gemspec.rz", "")
+	}
+	if n := repo.requestCount() - asked; n != 0 {
+		t.Errorf("repo asked %d times serving the snapshot: %v", n, repo.lastRequest().URL)
+	}
+}
+
+func TestSnapshotSurvivesCredentialRotation(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	dir := t.TempDir()
+	withCredentials := func(pass string) string {
+		return strings.Replace(repo.URL, "://", "://ci:"+pass+"@", 1)
+	}
+	configure(t, "-snapshot-mode", "capture", "-snapshot-dir", dir, "-repo", withCredentials("old"))
+	if _, err := depQuery([]string{"rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	configure(t, "-snapshot-mode", "serve", "-snapshot-dir", dir, "-repo", withCredentials("new"))
+	deps, err := depQuery([]string{"rack"}, defaultOptions())
+	if err != nil || !equalStrings(idents(deps), []string{"rack-1.0.0"}) {
+		t.Errorf("after rotating the password got %v, %v", idents(deps), err)
+	}
+}
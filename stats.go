@@ -0,0 +1,72 @@
+package main
+
+// A summary of how a single dependencies request was answered, for clients
+// that want to record what the proxy did without scraping metrics.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type queryStats struct {
+	mu       sync.Mutex
+	started  time.Time
+	Gems     int            `json:"gems"`
+	Repos    map[string]int `json:"repos"` // Versions returned per repo.
+	Shadowed int            `json:"shadowed"`
+	Cache    string         `json:"cache"`
+	Duration float64        `json:"duration_ms"`
+}
+
+// Clients opt in with X-Amalgemate-Stats, so nobody else pays for it.
+func wantStats(r *http.Request) bool {
+	b, _ := strconv.ParseBool(r.Header.Get("X-Amalgemate-Stats"))
+	return b
+}
+
+func newQueryStats(gems int) *queryStats {
+	return &queryStats{started: time.Now(), Gems: gems, Repos: make(map[string]int), Cache: "miss"}
+}
+
+func (s *queryStats) repoResult(repo *repository, n int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Repos[repo.public()] += n
+}
+
+func (s *queryStats) shadowed() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Shadowed++
+}
+
+func (s *queryStats) cacheHit() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Cache = "hit"
+}
+
+// Sends the summary as the X-Amalgemate-Stats response header.
+func (s *queryStats) write(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Duration = float64(time.Since(s.started)) / float64(time.Millisecond)
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	w.Header().Set("X-Amalgemate-Stats", string(b))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestQueryStats(t *testing.T) {
+	first := newFakeRepo(t, gem("rack", "1.0.0"))
+	second := newFakeRepo(t, gem("rack", "1.0.0"), gem("rack", "2.0.0"), gem("thor", "1.0.0"))
+	configure(t, "-cache-ttl", "1h", "-repo", first.URL, "-repo", second.URL)
+
+	for _, cache := range []string{"miss", "hit"} {
+		w := request(handleDependencies, "GET", dependencies("rack", "thor"), "", "X-Amalgemate-Stats", "true")
+		var stats queryStats
+		if err := json.Unmarshal([]byte(w.Header().Get("X-Amalgemate-Stats")), &stats); err != nil {
+			t.Fatalf("%s: %s", w.Header().Get("X-Amalgemate-Stats"), err)
+		}
+		if stats.Gems != 2 || stats.Cache != cache || stats.Duration <= 0 {
+			t.Errorf("%s", w.Header().Get("X-Amalgemate-Stats"))
+		}
+		if cache == "miss" && (stats.Repos[first.URL] != 1 || stats.Repos[second.URL] != 3 || stats.Shadowed != 1) {
+			t.Errorf("%s", w.Header().Get("X-Amalgemate-Stats"))
+		}
+	}
+
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Header().Get("X-Amalgemate-Stats") != "" {
+		t.Error("stats sent without being asked for")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+// A plain HTML status page for people, pulling together what /ready,
+// /metrics and /debug/requests say.
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+)
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>amalgemate status</title></head>
+<body>
+<h1>amalgemate</h1>
+<p>{{if .Ready}}Ready{{else}}Not ready, too many repositories are failing{{end}}{{if .Maintenance}}, in maintenance mode{{end}}.</p>
+
+<h2>Repositories</h2>
+<table>
+<tr><th>Priority</th><th>URL</th><th>Health</th><th>Failures in a row</th><th>Last error</th></tr>
+{{range .Repos}}<tr><td>{{.Priority}}</td><td>{{.URL}}</td><td>{{if .Healthy}}healthy{{else}}failing{{end}}</td><td>{{.Failures}}</td><td>{{.LastErr}}</td></tr>
+{{end}}</table>
+
+<h2>Cache</h2>
+<p>{{.CacheBytes}} bytes of dependency results cached in memory, {{.GemDir}} gems known to gemDir.</p>
+
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+<tr><th>Started</th><th>Request</th><th>Status</th><th>Took</th></tr>
+{{range .Errors}}<tr><td>{{.Started.Format "2006-01-02 15:04:05"}}</td><td>{{.Method}} {{.Path}}</td><td>{{.Status}}</td><td>{{.Elapsed}}</td></tr>
+{{end}}</table>{{else}}<p>None.</p>{{end}}
+</body>
+</html>
+`))
+
+type statusRepo struct {
+	Priority int
+	URL      string
+	Healthy  bool
+	Failures int
+	LastErr  string
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Ready       bool
+		Maintenance bool
+		Repos       []statusRepo
+		CacheBytes  int
+		GemDir      int
+		Errors      []tracedRequest
+	}{
+		Ready:       !degraded(),
+		Maintenance: maintenance.Load(),
+	}
+
+	for i, repo := range reposFlag {
+		repo.health.mu.Lock()
+		s := statusRepo{Priority: i, URL: repo.public(), Failures: repo.health.failures}
+		if repo.health.lastErr != nil && s.Failures > 0 {
+			s.LastErr = repo.health.lastErr.Error()
+		}
+		repo.health.mu.Unlock()
+		s.Healthy = repo.healthy()
+		data.Repos = append(data.Repos, s)
+	}
+
+	if c, ok := depCache.(*cache); ok {
+		data.CacheBytes = c.memoryBytes()
+	}
+	gemDirLock.RLock()
+	data.GemDir = len(gemDir)
+	gemDirLock.RUnlock()
+
+	for _, t := range recentTraced() {
+		if t.Status >= 500 {
+			t.Elapsed = t.Elapsed.Round(time.Millisecond)
+			data.Errors = append(data.Errors, t)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusPage.Execute(w, data)
+}
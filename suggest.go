@@ -0,0 +1,87 @@
+package main
+
+// Suggests the gem a client probably meant when it asks for one no repo has,
+// from the names gemDir has seen.
+
+import (
+	"sort"
+	"strings"
+)
+
+// Finds the closest known name to each missing gem, leaving out gems with
+// nothing close enough to be a likely typo.
+func suggestNames(missing []string) map[string]string {
+	gemDirLock.RLock()
+	known := make(map[string]bool)
+	for _, entry := range gemDir {
+		if entry.name != "" {
+			known[entry.name] = true
+		}
+	}
+	gemDirLock.RUnlock()
+
+	suggestions := make(map[string]string)
+	for _, name := range missing {
+		// A distance of up to two covers most typos, without suggesting
+		// unrelated short names.
+		best, bestDist := "", 3
+		if len(name) < 6 {
+			bestDist = 2
+		}
+		for candidate := range known {
+			d := editDistance(name, candidate)
+			if d == 0 {
+				continue
+			}
+			if d < bestDist || (d == bestDist && best != "" && candidate < best) {
+				best, bestDist = candidate, d
+			}
+		}
+		if best != "" {
+			suggestions[name] = best
+		}
+	}
+	return suggestions
+}
+
+// Formats suggestions as missing=suggestion pairs, for a header or message.
+func formatSuggestions(suggestions map[string]string) string {
+	var pairs []string
+	for name, suggestion := range suggestions {
+		pairs = append(pairs, name+"="+suggestion)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Levenshtein distance, except that swapping two adjacent letters is one edit
+// rather than two, since it's such a common typo.
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && prev2[j-2]+1 < cur[j] {
+				cur[j] = prev2[j-2] + 1
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"rails", "rails", 0},
+		{"rials", "rails", 1},
+		{"rialz", "rails", 2},
+		{"rail", "rails", 1},
+		{"", "rack", 4},
+		{"kitten", "sitting", 3},
+	} {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestSuggestions(t *testing.T) {
+	repo := newFakeRepo(t, gem("rails", "7.0.0"), gem("nokogiri", "1.15.0"), gem("rack", "1.0.0"))
+	configure(t, "-repo", repo.URL)
+	if _, err := depQuery([]string{"rails", "nokogiri", "rack"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(handleDependencies, "GET", dependencies("rials", "nokogri", "zebra"), "")
+	if got := w.Header().Get("X-Amalgemate-Suggestions"); got != "nokogri=nokogiri,rials=rails" {
+		t.Errorf("suggested %q", got)
+	}
+	w = request(handleDependencies, "GET", dependencies("rails", "zebra"), "")
+	if got := w.Header().Get("X-Amalgemate-Suggestions"); got != "" {
+		t.Errorf("suggested %q for a distant name", got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+// Server-Timing headers, so a client can see where a dependencies request's
+// time went without access to the server's metrics.
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collects timings while a query runs. Its methods do nothing on a nil
+// serverTiming, which is what queries get without -server-timing.
+type serverTiming struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func newServerTiming() *serverTiming {
+	if !serverTimingFlag {
+		return nil
+	}
+	return &serverTiming{}
+}
+
+func (t *serverTiming) add(name, desc string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, timingEntry(name, desc, d))
+}
+
+func (t *serverTiming) write(w http.ResponseWriter) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) > 0 {
+		w.Header().Add("Server-Timing", strings.Join(t.entries, ", "))
+	}
+}
+
+func timingEntry(name, desc string, d time.Duration) string {
+	return fmt.Sprintf("%s;desc=%q;dur=%.1f", name, desc, float64(d)/float64(time.Millisecond))
+}
+
+// Times a step the handler does itself once the query is done, which has to
+// finish before anything is written for its timing to be sent.
+func addTiming(w http.ResponseWriter, name, desc string, start time.Time) {
+	if serverTimingFlag {
+		w.Header().Add("Server-Timing", timingEntry(name, desc, time.Since(start)))
+	}
+}
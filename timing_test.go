@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var queryTiming = regexp.MustCompile(`query;desc="[^"]*";dur=([0-9.]+)`)
+
+func TestServerTiming(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	repo.setLatency(20 * time.Millisecond)
+
+	// JSON is only encoded up front to be cached, and otherwise streamed.
+	for _, c := range []struct {
+		args   []string
+		h      http.HandlerFunc
+		path   string
+		encode string
+	}{
+		{nil, handleDependencies, "/api/v1/dependencies", "Marshal encoding"},
+		{[]string{"-cache-ttl", "1h"}, handleDependenciesJSON, "/api/v1/dependencies.json", "JSON encoding"},
+	} {
+		configure(t, append(c.args, "-server-timing", "-repo", repo.URL)...)
+		w := request(c.h, "GET", c.path+"?gems=rack", "")
+		timing := strings.Join(w.Header()["Server-Timing"], ", ")
+		for _, want := range []string{
+			`query;desc="Cache lookup, upstream fetches and merge";dur=`,
+			`merge;desc="Merging repo responses";dur=`,
+			`encode;desc="` + c.encode + `";dur=`,
+		} {
+			if !strings.Contains(timing, want) {
+				t.Errorf("%s Server-Timing %q missing %q", c.path, timing, want)
+			}
+		}
+		if m := queryTiming.FindStringSubmatch(timing); m == nil {
+			t.Errorf("%s Server-Timing %q has no query duration", c.path, timing)
+		} else if ms, _ := strconv.ParseFloat(m[1], 64); ms < 20 {
+			t.Errorf("%s query took %sms, less than the repo's latency", c.path, m[1])
+		}
+	}
+
+	configure(t, "-repo", repo.URL)
+	if w := request(handleDependencies, "GET", dependencies("rack"), ""); w.Header().Get("Server-Timing") != "" {
+		t.Errorf("without -server-timing got %q", w.Header().Get("Server-Timing"))
+	}
+}
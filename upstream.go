@@ -0,0 +1,190 @@
+package main
+
+// The HTTP client used for all requests to upstream repositories.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var upstreamClient = http.DefaultClient
+
+// Limits the upstream requests in flight across all inbound requests, nil
+// when unlimited.
+var upstreamSem chan struct{}
+
+// The repo's own limit is waited on first, so a throttled repo doesn't hold
+// global slots that other repos could be using. Gives up waiting when ctx is
+// done.
+func acquireUpstream(ctx context.Context, repo *repository) error {
+	if repo.sem != nil {
+		select {
+		case repo.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if upstreamSem != nil {
+		select {
+		case upstreamSem <- struct{}{}:
+		case <-ctx.Done():
+			if repo.sem != nil {
+				<-repo.sem
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func releaseUpstream(repo *repository) {
+	if upstreamSem != nil {
+		<-upstreamSem
+	}
+	if repo.sem != nil {
+		<-repo.sem
+	}
+}
+
+func newUpstreamClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Forcing a fresh connection per request helps when debugging upstream
+	// connection problems.
+	transport.DisableKeepAlives = disableKeepAliveFlag
+	if upstreamAllow != nil {
+		transport.DialContext = upstreamAllow.dial
+		// Through a proxy only the proxy's host would be dialed, and so
+		// checked, so the allowlist means connecting directly.
+		transport.Proxy = nil
+	}
+
+	return &http.Client{
+		Transport:     viaTransport{transport},
+		CheckRedirect: checkUpstreamRedirect,
+	}
+}
+
+// Identifies this process in the Via header of its upstream requests, so a
+// misconfigured upstream or download base that leads back to amalgemate is
+// caught instead of looping. It's unique per process, so amalgemate can still
+// sit in front of another amalgemate.
+var viaToken = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "amalgemate-" + hex.EncodeToString(b)
+}()
+
+type viaTransport struct {
+	http.RoundTripper
+}
+
+func (t viaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Add("Via", "1.1 "+viaToken)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// Whether the request was made by this process, having come back round.
+func looped(r *http.Request) bool {
+	for _, via := range r.Header.Values("Via") {
+		if strings.Contains(via, viaToken) {
+			return true
+		}
+	}
+	return false
+}
+
+// An upstream redirecting somewhere unexpected is at best surprising, so the
+// number of redirects is capped and they can be held to the repo's own host.
+func checkUpstreamRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirectsFlag {
+		return fmt.Errorf("stopped after %d redirects", maxRedirectsFlag)
+	}
+	if sameHostRedirectsFlag && req.URL.Host != via[0].URL.Host {
+		return errors.New("refusing redirect from " + via[0].URL.Host + " to " + req.URL.Host)
+	}
+	return nil
+}
+
+var upstreamAllow *allowlist
+
+// The hosts upstream requests may be made to, so that repo config or a
+// redirect can't send amalgemate somewhere it shouldn't go. It's enforced when
+// dialing, so it covers every request made through the upstream client.
+type allowlist struct {
+	hosts []string // Host name patterns.
+	nets  []*net.IPNet
+}
+
+func parseAllowlist(entries []string) (*allowlist, error) {
+	a := &allowlist{}
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			a.nets = append(a.nets, n)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			if _, err := path.Match(entry, ""); err != nil {
+				return nil, err
+			}
+			a.hosts = append(a.hosts, strings.ToLower(entry))
+		}
+	}
+	return a, nil
+}
+
+func (a *allowlist) allowsHost(host string) bool {
+	for _, pattern := range a.hosts {
+		if ok, _ := path.Match(pattern, strings.ToLower(host)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *allowlist) allowsIP(ip net.IP) bool {
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts not allowed by name are resolved and the allowed address is dialed
+// directly, so the check can't be dodged by the name resolving differently
+// the second time.
+func (a *allowlist) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if a.allowsHost(host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if a.allowsIP(ip.IP) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("upstream host %s is not allowed by -upstream-allow", host)
+}
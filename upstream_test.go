@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Redirects every request to target, keeping the path.
+func redirector(t *testing.T, target string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusFound)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSameHostRedirects(t *testing.T) {
+	target := newFakeRepo(t, gem("rack", "1.0.0"))
+	redirect := redirector(t, target.URL)
+
+	configure(t, "-allow-deps-redirects", "-repo", redirect.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err != nil {
+		t.Errorf("off-host redirect not followed: %s", err)
+	}
+
+	configure(t, "-allow-deps-redirects", "-same-host-redirects", "-repo", redirect.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err == nil {
+		t.Error("off-host redirect followed with -same-host-redirects")
+	}
+	if n := target.requestCount(); n != 1 {
+		t.Errorf("redirect target asked %d times", n)
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL+r.URL.RequestURI(), http.StatusFound)
+	}))
+	defer loop.Close()
+
+	configure(t, "-max-redirects", "2", "-allow-deps-redirects", "-repo", loop.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err == nil {
+		t.Error("redirect loop followed")
+	}
+}
+
+func TestDisableKeepAlive(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		configure(t, "-disable-keepalive="+strconv.FormatBool(disabled))
+		transport := newUpstreamClient().Transport.(viaTransport).RoundTripper.(*http.Transport)
+		if transport.DisableKeepAlives != disabled {
+			t.Errorf("with -disable-keepalive=%t DisableKeepAlives is %t", disabled, transport.DisableKeepAlives)
+		}
+	}
+}
+
+func TestUpstreamAllow(t *testing.T) {
+	repo := newFakeRepo(t, gem("rack", "1.0.0"))
+	configure(t, "-upstream-allow", "gems.example.com,10.0.0.0/8", "-repo", repo.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("disallowed host got %v", err)
+	}
+	if transport := upstreamClient.Transport.(viaTransport).RoundTripper.(*http.Transport); transport.Proxy != nil {
+		t.Error("allowlisted client goes through the environment's proxy")
+	}
+
+	configure(t, "-upstream-allow", "127.0.0.1", "-repo", repo.URL)
+	if _, err := fetchDependencies(context.Background(), []string{"rack"}, reposFlag[0]); err != nil {
+		t.Errorf("allowed host got %v", err)
+	}
+}
+
+func TestRedirectLoopDetected(t *testing.T) {
+	second := newFakeRepo(t)
+	second.serveFile("gems/rack-1.0.0.gem", []byte("from second"))
+	self := httptest.NewUnstartedServer(nil)
+	// Sends downloads straight back to amalgemate.
+	looping := redirector(t, "http://"+self.Listener.Addr().String())
+	configure(t, "-proxy-downloads", "-repo", looping.URL, "-repo", second.URL)
+	self.Config = newServer()
+	self.Start()
+	t.Cleanup(self.Close)
+	gemDir["rack-1.0.0"] = gemDirEntry{repos: reposFlag, added: time.Now()}
+
+	res, err := upstreamClient.Get(self.URL + "/gems/rack-1.0.0.gem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusLoopDetected {
+		t.Errorf("request from this server got %d", res.StatusCode)
+	}
+
+	w := request(handleGem, "GET", "/gems/rack-1.0.0.gem", "")
+	if w.Code != http.StatusOK || w.Body.String() != "from second" {
+		t.Errorf("got %d %q", w.Code, w.Body)
+	}
+}
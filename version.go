@@ -0,0 +1,89 @@
+package main
+
+// Orders gem versions the way RubyGems does, for the few places that need to
+// know which version is newest.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var versionSegment = regexp.MustCompile(`[0-9]+|[a-zA-Z]+`)
+
+// The versions RubyGems accepts.
+var validVersion = regexp.MustCompile(`^[0-9]+(\.[0-9a-zA-Z]+)*(-[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
+// Returns -1, 0 or 1 as a is older than, the same as or newer than b. Versions
+// are split into runs of digits and letters. Numbers compare numerically,
+// letters compare as strings and sort before any number, so 1.0.a is a
+// prerelease of 1.0. Missing segments count as zero, so 1.0 and 1.0.0 are the
+// same. Versions RubyGems wouldn't accept sort before everything, and among
+// themselves as plain strings.
+func compareVersions(a, b string) int {
+	aValid, bValid := parseableVersion(a), parseableVersion(b)
+	switch {
+	case !aValid && !bValid:
+		return strings.Compare(a, b)
+	case !aValid:
+		return -1
+	case !bValid:
+		return 1
+	}
+
+	as := versionSegment.FindAllString(a, -1)
+	bs := versionSegment.FindAllString(b, -1)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if c := compareSegments(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareSegments(x, y string) int {
+	xNum, yNum := isDigits(x), isDigits(y)
+	switch {
+	case xNum && yNum:
+		// Compared as digit strings, so there's no overflow to worry about.
+		x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+		if len(x) != len(y) {
+			if len(x) < len(y) {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(x, y)
+	case xNum:
+		return 1
+	case yNum:
+		return -1
+	}
+	return strings.Compare(x, y)
+}
+
+func isDigits(s string) bool {
+	return s[0] >= '0' && s[0] <= '9'
+}
+
+// Malformed versions already warned about, so a repo serving one doesn't flood
+// the log each time it's compared.
+var warnedVersions sync.Map
+
+func parseableVersion(v string) bool {
+	if validVersion.MatchString(strings.TrimSpace(v)) {
+		return true
+	}
+	if _, warned := warnedVersions.LoadOrStore(v, true); !warned {
+		fmt.Printf("Warning: can't parse version %q, treating it as older than any other\n", v)
+	}
+	return false
+}
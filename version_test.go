@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "10.0.0", -1},
+		{"1.0.0.1", "1.0.0", 1},
+		{"1.0.0", "1.0.0.rc1", 1},
+		{"1.0.0.rc2", "1.0.0.rc1", 1},
+		{"1.0.0.rc1", "1.0.0.beta9", 1},
+		{"1.0.0.pre", "0.9.9", 1},
+		{"1.0.a", "1.0", -1},
+		{"99999999999999999999.0", "99999999999999999998.0", 1},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := compareVersions(c.b, c.a); got != -c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
+
+func TestLatestKnownVersion(t *testing.T) {
+	repo := newFakeRepo(t,
+		gem("rack", "1.9.0"), gem("rack", "1.10.0"), gem("rack", "2.0.0.rc1"),
+		gem("rails", "7.1.0.beta1"), gem("rails", "7.1.0.rc1"),
+	)
+	configure(t, "-versionless-gems", "latest", "-repo", repo.URL)
+	if _, err := depQuery([]string{"rack", "rails"}, defaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Releases win over newer prereleases, unless there are only prereleases.
+	for name, want := range map[string]string{"rack": "1.10.0", "rails": "7.1.0.rc1"} {
+		if got, ok := latestKnownVersion(name); !ok || got != want {
+			t.Errorf("latest %s is %q", name, got)
+		}
+	}
+	if w := request(handleGem, "GET", "/gems/rack.gem", ""); w.Code != http.StatusFound || w.Header().Get("Location") != "/gems/rack-1.10.0.gem" {
+		t.Errorf("got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := request(handleGem, "GET", "/gems/thor.gem", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown gem got %d", w.Code)
+	}
+
+	configure(t, "-repo", repo.URL)
+	if w := request(handleGem, "GET", "/gems/rack.gem", ""); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "No version given") {
+		t.Errorf("without -versionless-gems got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestCompareMalformedVersions(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"0.0.1", "garbage!", 1},
+		{"0.0.1", "", 1},
+		{"0.1", "1..0", 1},
+		{"0", "-1", 1},
+		{"0.1", "v1.0", 1},
+		{"1.0.0", "1.0.0 beta", 1},
+		{" 1.0.0 ", "1.0.0", 0},
+		{"01.0", "1.0", 0},
+		{"1.0.0.rc.1.2", "1.0.0.rc.1", 1},
+		{"1.0.0.rc.10", "1.0.0.rc.9", 1},
+		{"1.0.0", "1.0.0-beta-2", 1},
+		// Malformed versions still have an order among themselves.
+		{"abd", "abc", 1},
+		{"v1", "v1", 0},
+	} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+		if got := compareVersions(c.b, c.a); got != -c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
+
+func TestMalformedVersionLoggedOnce(t *testing.T) {
+	out := captureOutput(t, func() {
+		for i := 0; i < 3; i++ {
+			compareVersions("1.0.0", "not a version")
+		}
+	})
+	if n := strings.Count(out, `can't parse version "not a version"`); n != 1 {
+		t.Errorf("logged %d times: %q", n, out)
+	}
+}